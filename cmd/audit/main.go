@@ -0,0 +1,62 @@
+// Audit checks the audit log written by gateway, the records must chain from the first file to the last.
+//
+//	./audit verify [-key KEY] <dir or file>...
+//
+// A directory stands for all the files of the log in it, in the order they were written. The key must be
+// the key of gateway's audit config, if it has one.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/bcmmacro/bridging-go/internal/audit"
+)
+
+func main() {
+	if len(os.Args) < 2 || os.Args[1] != "verify" {
+		fmt.Fprintln(os.Stderr, "Usage: ./audit verify [-key KEY] <dir or file>...")
+		os.Exit(2)
+	}
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	key := flags.String("key", "", "HMAC key of the chain, the key of gateway's audit config")
+	flags.Parse(os.Args[2:])
+	if flags.NArg() == 0 {
+		fmt.Fprintln(os.Stderr, "Usage: ./audit verify [-key KEY] <dir or file>...")
+		os.Exit(2)
+	}
+
+	var files []string
+	for _, arg := range flags.Args() {
+		info, err := os.Stat(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		if !info.IsDir() {
+			files = append(files, arg)
+			continue
+		}
+		dirFiles, err := audit.Files(arg)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		files = append(files, dirFiles...)
+	}
+
+	s, err := audit.Verify(files, []byte(*key))
+	if err != nil {
+		fmt.Printf("FAILED after %d records: %v\n", s.Records, err)
+		os.Exit(1)
+	}
+	if s.Records == 0 {
+		fmt.Println("OK no records")
+		return
+	}
+	fmt.Printf("OK %d records seq[%d..%d] last hash[%s]\n", s.Records, s.FirstSeq, s.LastSeq, s.LastHash)
+	if s.FirstPrev != "" {
+		fmt.Printf("The chain starts after hash[%s], the records before are not in these files\n", s.FirstPrev)
+	}
+}
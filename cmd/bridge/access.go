@@ -0,0 +1,194 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// accessRules restrict who can reach bridge by client address and country: gateway on /bridge, and the public
+// globally and per path prefix. The client address is taken from X-Forwarded-For of trusted proxies.
+type accessRules struct {
+	gateway accessRule
+	global  accessRule
+	routes  []routeAccess // longest prefix first
+	geo     *geoIP        // nil if countries are not known
+}
+
+// accessRule denies the clients in deny, and the clients not in allow unless allow is empty.
+type accessRule struct {
+	allow accessList
+	deny  accessList
+}
+
+type routeAccess struct {
+	prefix string
+	rule   accessRule
+}
+
+// accessList has networks and two-letter country codes.
+type accessList struct {
+	nets      []*net.IPNet
+	countries map[string]bool
+}
+
+func (l *accessList) empty() bool {
+	return len(l.nets) == 0 && len(l.countries) == 0
+}
+
+func (l *accessList) contains(ip net.IP, country string) bool {
+	for _, ipNet := range l.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return country != "" && l.countries[country]
+}
+
+// parseAccessList parses CIDRs, IPs and country codes separated by commas or spaces.
+func parseAccessList(s string) (accessList, error) {
+	l := accessList{countries: map[string]bool{}}
+	for _, v := range strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' }) {
+		if len(v) == 2 && strings.Trim(strings.ToUpper(v), "ABCDEFGHIJKLMNOPQRSTUVWXYZ") == "" {
+			l.countries[strings.ToUpper(v)] = true
+			continue
+		}
+		ipNet, err := parseCIDR(v)
+		if err != nil {
+			return l, fmt.Errorf("invalid cidr or country[%s]", v)
+		}
+		l.nets = append(l.nets, ipNet)
+	}
+	return l, nil
+}
+
+// parseRouteAccess parses per route lists like "/admin=10.0.0.0/8 192.168.0.0/16,/reports=SG MY".
+func parseRouteAccess(s string, set func(prefix string, l accessList)) error {
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		parts := strings.SplitN(m, "=", 2)
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return fmt.Errorf("invalid route access[%s]", m)
+		}
+		l, err := parseAccessList(parts[1])
+		if err != nil {
+			return err
+		}
+		set(strings.TrimSpace(parts[0]), l)
+	}
+	return nil
+}
+
+// newAccessRules makes the access rules from the BRIDGE_*ALLOW, BRIDGE_*DENY and BRIDGE_GEOIP_FILE env.
+func newAccessRules() (*accessRules, error) {
+	a := &accessRules{}
+	lists := []struct {
+		env  string
+		list *accessList
+	}{
+		{"BRIDGE_GATEWAY_ALLOW", &a.gateway.allow},
+		{"BRIDGE_GATEWAY_DENY", &a.gateway.deny},
+		{"BRIDGE_ALLOW", &a.global.allow},
+		{"BRIDGE_DENY", &a.global.deny},
+	}
+	countries := false
+	for _, l := range lists {
+		var err error
+		if *l.list, err = parseAccessList(os.Getenv(l.env)); err != nil {
+			return nil, err
+		}
+		countries = countries || len(l.list.countries) > 0
+	}
+
+	routes := map[string]*accessRule{}
+	route := func(prefix string) *accessRule {
+		if _, present := routes[prefix]; !present {
+			routes[prefix] = &accessRule{}
+		}
+		return routes[prefix]
+	}
+	if err := parseRouteAccess(os.Getenv("BRIDGE_ROUTE_ALLOW"), func(prefix string, l accessList) { route(prefix).allow = l }); err != nil {
+		return nil, err
+	}
+	if err := parseRouteAccess(os.Getenv("BRIDGE_ROUTE_DENY"), func(prefix string, l accessList) { route(prefix).deny = l }); err != nil {
+		return nil, err
+	}
+	for prefix, rule := range routes {
+		a.routes = append(a.routes, routeAccess{prefix: prefix, rule: *rule})
+		countries = countries || len(rule.allow.countries) > 0 || len(rule.deny.countries) > 0
+	}
+	sort.Slice(a.routes, func(i, j int) bool { return len(a.routes[i].prefix) > len(a.routes[j].prefix) })
+
+	if file := os.Getenv("BRIDGE_GEOIP_FILE"); file != "" {
+		var err error
+		if a.geo, err = loadGeoIP(file); err != nil {
+			return nil, fmt.Errorf("failed to load geoip file[%s] error[%v]", file, err)
+		}
+	} else if countries {
+		return nil, fmt.Errorf("country rules require BRIDGE_GEOIP_FILE")
+	}
+	return a, nil
+}
+
+// check returns an error if the client of the request is not allowed. The deny lists of the route and global
+// both apply, the allow list of the route takes the place of the global one.
+func (a *accessRules) check(r *http.Request, proxies trustedProxies) error {
+	return a.checkClient(proxies.clientIP(r), r.URL.Path)
+}
+
+// checkTCP returns an error if the client of a tunneled tcp connection is not allowed, the global lists apply.
+func (a *accessRules) checkTCP(conn net.Conn) error {
+	return a.checkClient(remoteIP(conn.RemoteAddr().String()), "")
+}
+
+// checkClient checks the client address for the path, which is empty for a tcp connection.
+func (a *accessRules) checkClient(client string, p string) error {
+	ip := net.ParseIP(client)
+	if ip == nil {
+		return fmt.Errorf("invalid client ip[%s]", client)
+	}
+	country := ""
+	if a.geo != nil {
+		country = a.geo.country(ip)
+	}
+
+	deny := []*accessList{&a.global.deny}
+	allow := &a.global.allow
+	if p == "/bridge" {
+		deny, allow = []*accessList{&a.gateway.deny}, &a.gateway.allow
+	} else if p != "" {
+		for i := range a.routes {
+			if underPrefix(p, a.routes[i].prefix) {
+				deny = append(deny, &a.routes[i].rule.deny)
+				if !a.routes[i].rule.allow.empty() {
+					allow = &a.routes[i].rule.allow
+				}
+				break
+			}
+		}
+	}
+	for _, l := range deny {
+		if l.contains(ip, country) {
+			return fmt.Errorf("client[%s] country[%s] is denied", client, country)
+		}
+	}
+	if !allow.empty() && !allow.contains(ip, country) {
+		return fmt.Errorf("client[%s] country[%s] is not allowed", client, country)
+	}
+	return nil
+}
+
+// underPrefix tells if the path is the path prefix or below it, segment by segment once "." and ".." are
+// resolved, so that /api covers neither /apix nor /api/../admin.
+func underPrefix(p string, prefix string) bool {
+	p = path.Clean("/" + p)
+	prefix = strings.TrimSuffix(prefix, "/")
+	return prefix == "" || p == prefix || strings.HasPrefix(p, prefix+"/")
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bcmmacro/bridging-go/internal/auth"
+	"github.com/bcmmacro/bridging-go/internal/seal"
+)
+
+// authTimeout is how long gateway has to answer the challenge.
+const authTimeout = 10 * time.Second
+
+var errInvalidToken = errors.New("invalid bridge token")
+
+// authenticate tells if the peer of ws is gateway. With BRIDGE_GATEWAY_KEYS gateway must sign a fresh challenge
+// with one of the keys, otherwise it must present BRIDGE_TOKEN.
+func (f *Forwarder) authenticate(bridgingToken string, ws *websocket.Conn) error {
+	if len(f.gatewayKeys) == 0 {
+		if subtle.ConstantTimeCompare([]byte(bridgingToken), []byte(f.bridgingToken)) != 1 {
+			return errInvalidToken
+		}
+		return nil
+	}
+
+	challenge, err := auth.NewChallenge()
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(authTimeout)
+	ws.SetWriteDeadline(deadline)
+	if err := ws.WriteJSON(challenge); err != nil {
+		return err
+	}
+	ws.SetReadDeadline(deadline)
+	var resp auth.Response
+	if err := ws.ReadJSON(&resp); err != nil {
+		return err
+	}
+	ws.SetReadDeadline(time.Time{})
+	ws.SetWriteDeadline(time.Time{})
+	return f.gatewayKeys.Verify(challenge, resp, time.Now())
+}
+
+// startSession exchanges the salts of a sealed session with gateway.
+func (f *Forwarder) startSession(ws *websocket.Conn) (*seal.Session, error) {
+	own, err := seal.NewHello()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(authTimeout)
+	ws.SetWriteDeadline(deadline)
+	if err := ws.WriteJSON(own); err != nil {
+		return nil, err
+	}
+	ws.SetReadDeadline(deadline)
+	var peer seal.Hello
+	if err := ws.ReadJSON(&peer); err != nil {
+		return nil, err
+	}
+	ws.SetReadDeadline(time.Time{})
+	ws.SetWriteDeadline(time.Time{})
+	return f.sealKeys.NewSession(own, peer)
+}
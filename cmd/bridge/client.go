@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bcmmacro/bridging-go/internal/flow"
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/library/common"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+// wsClient is a public websocket connection. Messages from gateway are queued and written
+// by its own goroutine, which is the only writer of the connection, so that a slow client
+// does not hold up the bridge.
+type wsClient struct {
+	ws    *websocket.Conn
+	queue *flow.Queue
+	done  chan struct{}
+}
+
+// parseClientPolicy parses the overflow policy of the client write queues, disconnect if s is empty.
+// The bridge read loop must never block, so block is rejected: gateway is held back by the window instead,
+// and a full queue means the window is not respected.
+func parseClientPolicy(s string) (flow.Policy, error) {
+	if s == "" {
+		return flow.PolicyDisconnect, nil
+	}
+	policy, err := flow.ParsePolicy(s)
+	if err == nil && policy == flow.PolicyBlock {
+		return "", fmt.Errorf("overflow policy[block] would block the bridge read loop, use drop_oldest or disconnect")
+	}
+	return policy, err
+}
+
+func (f *Forwarder) newClient(ctx context.Context, wsID string, ws *websocket.Conn) *wsClient {
+	c := &wsClient{ws: ws, queue: flow.NewQueue(int(f.wsWindow), f.wsPolicy), done: make(chan struct{})}
+	go f.writeClient(ctx, wsID, c)
+	return c
+}
+
+// close lets the writer send the queued messages and a close message, then close the connection.
+func (c *wsClient) close() {
+	c.queue.Close()
+}
+
+// push queues a message from gateway for the client without blocking.
+func (f *Forwarder) push(ctx context.Context, wsID string, c *wsClient, msg []byte) {
+	logger := log.Ctx(ctx)
+	dropped, err := c.queue.Push(msg)
+	if dropped > 0 {
+		logger.Warnf("slow client, dropped %d msgs ws[%s]", dropped, wsID)
+		if err := f.ack(ctx, wsID, int64(dropped)); err != nil {
+			logger.Warnf("failed to grant window, disconnecting ws[%s] error[%v]", wsID, err)
+			c.ws.Close()
+			return
+		}
+	}
+	if err != nil {
+		logger.Warnf("slow client, disconnecting ws[%s] error[%v]", wsID, err)
+		c.ws.Close()
+	}
+}
+
+// writeClient writes the queued messages to the client, and grants the consumed window back to gateway.
+func (f *Forwarder) writeClient(ctx context.Context, wsID string, c *wsClient) {
+	logger := log.Ctx(ctx)
+	defer func() {
+		c.queue.Close()
+		c.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second*3))
+		c.ws.Close()
+		close(c.done)
+	}()
+
+	ackEvery := f.wsWindow / 2
+	if ackEvery < 1 {
+		ackEvery = 1
+	}
+	var consumed int64
+	for {
+		msg, ok := c.queue.Pop()
+		if !ok {
+			return
+		}
+		c.ws.SetWriteDeadline(time.Now().Add(f.wsTimeout))
+		if err := c.ws.WriteMessage(websocket.TextMessage, msg.([]byte)); err != nil {
+			logger.Warnf("failed to write websocket ws[%s] error[%v]", wsID, err)
+			return
+		}
+		consumed++
+		if consumed >= ackEvery {
+			if err := f.ack(ctx, wsID, consumed); err != nil {
+				logger.Warnf("failed to grant window, disconnecting ws[%s] error[%v]", wsID, err)
+				return
+			}
+			consumed = 0
+		}
+	}
+}
+
+// ack grants credit back to gateway. A lost ack is never granted again and would stall the websocket for good,
+// so the caller must close the websocket if it fails.
+func (f *Forwarder) ack(ctx context.Context, wsID string, credit int64) error {
+	_, corrID := common.CorrIDCtx(ctx)
+	return f.send(ctx, &proto.Packet{
+		CorrID: corrID,
+		Method: proto.WEBSOCKET_ACK,
+		Args:   &proto.Args{WSID: wsID, Credit: credit}})
+}
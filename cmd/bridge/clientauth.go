@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/auth"
+)
+
+var (
+	errNoCredentials  = errors.New("no credentials")
+	errInvalidAPIKey  = errors.New("invalid api key")
+	errInactiveToken  = errors.New("inactive token")
+	errNoBearerMethod = errors.New("bearer tokens are not accepted")
+)
+
+// clientAuth authenticates the public clients with api keys, JWTs or OAuth2 token introspection, and passes
+// their identity to gateway in headers signed with BRIDGE_IDENTITY_KEY.
+type clientAuth struct {
+	apiKeys      map[string]auth.Identity // by hex sha256 of the key
+	apiKeyHeader string
+	jwt          *jwtVerifier
+	introspector *introspector
+	rolesClaim   string // claim of the roles in JWTs and introspection responses
+	optional     bool   // clients without credentials pass without an identity
+	keyID        string
+	key          []byte
+}
+
+type apiKeyConfig struct {
+	Key       string   `json:"key"`
+	KeySHA256 string   `json:"key_sha256"` // hex, instead of the key itself
+	Subject   string   `json:"subject"`
+	Roles     []string `json:"roles"`
+	Scopes    []string `json:"scopes"`
+}
+
+// newClientAuth makes the client authentication from the BRIDGE_AUTH_* and BRIDGE_IDENTITY_* env, nil if it is disabled.
+func newClientAuth() (*clientAuth, error) {
+	a := &clientAuth{
+		apiKeyHeader: os.Getenv("BRIDGE_AUTH_API_KEY_HEADER"),
+		rolesClaim:   os.Getenv("BRIDGE_AUTH_ROLES_CLAIM"),
+		optional:     os.Getenv("BRIDGE_AUTH_OPTIONAL") == "true",
+		keyID:        os.Getenv("BRIDGE_IDENTITY_KEY_ID"),
+		key:          []byte(os.Getenv("BRIDGE_IDENTITY_KEY")),
+	}
+	if a.apiKeyHeader == "" {
+		a.apiKeyHeader = "X-Api-Key"
+	}
+	if a.rolesClaim == "" {
+		a.rolesClaim = "roles"
+	}
+	if file := os.Getenv("BRIDGE_AUTH_API_KEYS_FILE"); file != "" {
+		var err error
+		if a.apiKeys, err = loadAPIKeys(file); err != nil {
+			return nil, err
+		}
+	}
+	if jwks := os.Getenv("BRIDGE_AUTH_JWKS"); jwks != "" {
+		var err error
+		if a.jwt, err = newJWTVerifier(jwks, os.Getenv("BRIDGE_AUTH_JWT_ISSUER"), os.Getenv("BRIDGE_AUTH_JWT_AUDIENCE")); err != nil {
+			return nil, fmt.Errorf("failed to load jwks error[%v]", err)
+		}
+	}
+	if endpoint := os.Getenv("BRIDGE_AUTH_INTROSPECTION_URL"); endpoint != "" {
+		var err error
+		if a.introspector, err = newIntrospector(endpoint); err != nil {
+			return nil, err
+		}
+	}
+	if a.apiKeys == nil && a.jwt == nil && a.introspector == nil {
+		return nil, nil
+	}
+	if len(a.key) == 0 {
+		return nil, errors.New("client authentication requires BRIDGE_IDENTITY_KEY")
+	}
+	return a, nil
+}
+
+func loadAPIKeys(file string) (map[string]auth.Identity, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var confs []apiKeyConfig
+	if err := json.Unmarshal(data, &confs); err != nil {
+		return nil, err
+	}
+	keys := map[string]auth.Identity{}
+	for _, c := range confs {
+		hash := strings.ToLower(c.KeySHA256)
+		if c.Key != "" {
+			sum := sha256.Sum256([]byte(c.Key))
+			hash = hex.EncodeToString(sum[:])
+		}
+		if hash == "" || c.Subject == "" {
+			return nil, fmt.Errorf("api key of subject[%s] needs a key and a subject", c.Subject)
+		}
+		keys[hash] = auth.Identity{Subject: c.Subject, Roles: c.Roles, Scopes: c.Scopes, Via: "api_key"}
+	}
+	return keys, nil
+}
+
+// authenticate returns the identity of the client, nil if it presents no credentials and they are optional.
+func (a *clientAuth) authenticate(r *http.Request) (*auth.Identity, error) {
+	if key := r.Header.Get(a.apiKeyHeader); key != "" && a.apiKeys != nil {
+		id, present := a.apiKey(key)
+		if !present {
+			return nil, errInvalidAPIKey
+		}
+		return &id, nil
+	}
+	if token := bearerToken(r); token != "" {
+		return a.authenticateBearer(token)
+	}
+	if a.optional {
+		return nil, nil
+	}
+	return nil, errNoCredentials
+}
+
+// apiKey returns the identity of the api key.
+func (a *clientAuth) apiKey(key string) (auth.Identity, bool) {
+	// keys are looked up by their hash, which does not leak them through timing
+	sum := sha256.Sum256([]byte(key))
+	id, present := a.apiKeys[hex.EncodeToString(sum[:])]
+	return id, present
+}
+
+// subjectOfAPIKey returns the subject of a known api key, empty for any other key.
+func (a *clientAuth) subjectOfAPIKey(key string) string {
+	if a == nil {
+		return ""
+	}
+	id, _ := a.apiKey(key)
+	return id.Subject
+}
+
+// authenticateBearer verifies JWTs locally, other tokens are introspected.
+func (a *clientAuth) authenticateBearer(token string) (*auth.Identity, error) {
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		claims, err := a.jwt.verify(token)
+		if err != nil {
+			return nil, err
+		}
+		return a.identityOf(claims, "jwt"), nil
+	}
+	if a.introspector != nil {
+		claims, err := a.introspector.introspect(token)
+		if err != nil {
+			return nil, err
+		}
+		return a.identityOf(claims, "introspection"), nil
+	}
+	return nil, errNoBearerMethod
+}
+
+func (a *clientAuth) identityOf(claims map[string]interface{}, via string) *auth.Identity {
+	id := &auth.Identity{Via: via, Roles: stringsOf(claims[a.rolesClaim])}
+	id.Subject, _ = claims["sub"].(string)
+	if id.Subject == "" {
+		// introspection responses of client credentials may only name the client
+		id.Subject, _ = claims["client_id"].(string)
+	}
+	id.Issuer, _ = claims["iss"].(string)
+	if scope, ok := claims["scope"].(string); ok {
+		id.Scopes = strings.Fields(scope)
+	} else {
+		id.Scopes = stringsOf(claims["scp"])
+	}
+	return id
+}
+
+// requestOf is the request as gateway whitelists it, which the identity of the client is signed for.
+func requestOf(corrID string, r *http.Request, isWebsocket bool) auth.Request {
+	req := auth.Request{CorrID: corrID, Method: strings.ToUpper(r.Method), Netloc: r.Header.Get("bridging-base-url"), Path: r.URL.Path}
+	if isWebsocket {
+		req.Method, req.Netloc = "WEBSOCKET", r.URL.Query().Get("bridging-base-url")
+	} else if isGRPC(r) {
+		req.Method = "GRPC"
+	}
+	return req
+}
+
+// challenge is the WWW-Authenticate header of 401 responses.
+func (a *clientAuth) challenge() string {
+	if a.jwt != nil || a.introspector != nil {
+		return "Bearer"
+	}
+	return ""
+}
+
+func bearerToken(r *http.Request) string {
+	h := r.Header.Get("Authorization")
+	if len(h) > 7 && strings.EqualFold(h[:7], "bearer ") {
+		return strings.TrimSpace(h[7:])
+	}
+	return ""
+}
+
+// introspector asks an OAuth2 introspection endpoint (RFC 7662) about opaque tokens, answers are cached for a while.
+type introspector struct {
+	endpoint     string
+	clientID     string
+	clientSecret string
+	ttl          time.Duration
+	client       *http.Client
+	mutex        sync.Mutex
+	cache        map[string]introspection // by hex sha256 of the token
+}
+
+type introspection struct {
+	claims  map[string]interface{}
+	expires time.Time
+}
+
+func newIntrospector(endpoint string) (*introspector, error) {
+	ttl := 60
+	if s := os.Getenv("BRIDGE_AUTH_INTROSPECTION_CACHE_SECONDS"); s != "" {
+		var err error
+		if ttl, err = strconv.Atoi(s); err != nil || ttl < 0 {
+			return nil, fmt.Errorf("invalid introspection cache seconds[%s]", s)
+		}
+	}
+	return &introspector{
+		endpoint:     endpoint,
+		clientID:     os.Getenv("BRIDGE_AUTH_INTROSPECTION_CLIENT_ID"),
+		clientSecret: os.Getenv("BRIDGE_AUTH_INTROSPECTION_CLIENT_SECRET"),
+		ttl:          time.Duration(ttl) * time.Second,
+		client:       &http.Client{Timeout: 10 * time.Second},
+		cache:        map[string]introspection{},
+	}, nil
+}
+
+func (i *introspector) introspect(token string) (map[string]interface{}, error) {
+	sum := sha256.Sum256([]byte(token))
+	hash := hex.EncodeToString(sum[:])
+	now := time.Now()
+	i.mutex.Lock()
+	cached, present := i.cache[hash]
+	i.mutex.Unlock()
+	if present && now.Before(cached.expires) {
+		return cached.claims, nil
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequest(http.MethodPost, i.endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.clientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.clientID), url.QueryEscape(i.clientSecret))
+	}
+	resp, err := i.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("introspection status[%d]", resp.StatusCode)
+	}
+	var claims map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&claims); err != nil {
+		return nil, err
+	}
+	if active, _ := claims["active"].(bool); !active {
+		return nil, errInactiveToken
+	}
+
+	expires := now.Add(i.ttl)
+	if exp, ok := claims["exp"].(float64); ok && time.Unix(int64(exp), 0).Before(expires) {
+		expires = time.Unix(int64(exp), 0)
+	}
+	i.mutex.Lock()
+	for k, v := range i.cache {
+		if now.After(v.expires) {
+			delete(i.cache, k)
+		}
+	}
+	i.cache[hash] = introspection{claims: claims, expires: expires}
+	i.mutex.Unlock()
+	return claims, nil
+}
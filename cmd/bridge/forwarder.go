@@ -3,7 +3,9 @@ package main
 import (
 	"compress/gzip"
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"os"
@@ -13,21 +15,50 @@ import (
 
 	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
 
+	"github.com/bcmmacro/bridging-go/internal/auth"
+	"github.com/bcmmacro/bridging-go/internal/flow"
 	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/internal/seal"
 	"github.com/bcmmacro/bridging-go/library/common"
 	errors2 "github.com/bcmmacro/bridging-go/library/errors"
 	http2 "github.com/bcmmacro/bridging-go/library/http"
 	"github.com/bcmmacro/bridging-go/library/log"
 )
 
+var (
+	errBridgeDisconnected = errors.New("bridge is disconnected")
+	errSendQueueFull      = errors.New("bridge send queue is full")
+)
+
 type Forwarder struct {
 	bridgingToken string
+	gatewayKeys   auth.Keys  // keys gateway signs the challenge with, the token is used if empty
+	sealKeys      *seal.Keys // keys the packets on /bridge are sealed with, nil if they are not
 	compressLevel int64
 	bridge        *websocket.Conn
+	out           chan sendItem   // packets to be sent to bridge
+	connected     context.Context // done once the bridge disconnects, nil if no bridge
+	outSize       int64
 	mutex         sync.Mutex
 	reqs          map[string]chan *proto.Args
-	wss           map[string]*websocket.Conn
+	infos         map[string]chan *proto.Args // 1xx responses of in-flight http requests
+	streams       map[string]*flow.Queue      // bodies of streamed http responses
+	streamSize    int64
+	wss           map[string]*wsClient
+	tcps          map[string]*tcpConn
+	wsWindow      int64
+	wsPolicy      flow.Policy
+	wsTimeout     time.Duration
+	proxies       trustedProxies
+	limits        bodyLimits
+}
+
+type sendItem struct {
+	ctx    context.Context
+	packet *proto.Packet
+	queued time.Time
 }
 
 func NewForwarder() *Forwarder {
@@ -39,16 +70,84 @@ func NewForwarder() *Forwarder {
 			return nil
 		}
 	}
-	return &Forwarder{
+	if _, err := gzip.NewWriterLevel(ioutil.Discard, int(level)); err != nil {
+		return nil
+	}
+	var outSize int64 = 1024
+	if outSizeEnv := os.Getenv("BRIDGE_SEND_QUEUE_SIZE"); outSizeEnv != "" {
+		var err error
+		if outSize, err = strconv.ParseInt(outSizeEnv, 10, 64); err != nil || outSize <= 0 {
+			return nil
+		}
+	}
+	var window int64 = 64
+	if windowEnv := os.Getenv("BRIDGE_WS_WINDOW"); windowEnv != "" {
+		var err error
+		if window, err = strconv.ParseInt(windowEnv, 10, 64); err != nil || window <= 0 {
+			return nil
+		}
+	}
+	policy, err := parseClientPolicy(os.Getenv("BRIDGE_WS_OVERFLOW_POLICY"))
+	if err != nil {
+		logrus.Errorf("invalid BRIDGE_WS_OVERFLOW_POLICY error[%v]", err)
+		return nil
+	}
+	var streamSize int64 = 256
+	if streamSizeEnv := os.Getenv("BRIDGE_STREAM_QUEUE_SIZE"); streamSizeEnv != "" {
+		if streamSize, err = strconv.ParseInt(streamSizeEnv, 10, 64); err != nil || streamSize <= 0 {
+			return nil
+		}
+	}
+	var timeout int64 = 10
+	if timeoutEnv := os.Getenv("BRIDGE_WS_WRITE_TIMEOUT"); timeoutEnv != "" {
+		if timeout, err = strconv.ParseInt(timeoutEnv, 10, 64); err != nil {
+			return nil
+		}
+	}
+	proxies, err := parseTrustedProxies(os.Getenv("BRIDGE_TRUSTED_PROXIES"))
+	if err != nil {
+		return nil
+	}
+	limits, err := parseBodyLimits(os.Getenv("BRIDGE_MAX_BODY_SIZE"), os.Getenv("BRIDGE_ROUTE_MAX_BODY_SIZE"))
+	if err != nil {
+		return nil
+	}
+	gatewayKeys, err := auth.ParseKeys(os.Getenv("BRIDGE_GATEWAY_KEYS"))
+	if err != nil {
+		return nil
+	}
+	sealKeys, err := seal.ParseKeys(os.Getenv("BRIDGE_SEAL_KEYS"))
+	if err != nil {
+		return nil
+	}
+	f := &Forwarder{
 		bridgingToken: os.Getenv("BRIDGE_TOKEN"),
+		gatewayKeys:   gatewayKeys,
+		sealKeys:      sealKeys,
 		compressLevel: level,
+		outSize:       outSize,
 		reqs:          make(map[string]chan *proto.Args),
-		wss:           make(map[string]*websocket.Conn)}
+		infos:         make(map[string]chan *proto.Args),
+		streams:       make(map[string]*flow.Queue),
+		streamSize:    streamSize,
+		wss:           make(map[string]*wsClient),
+		tcps:          make(map[string]*tcpConn),
+		wsWindow:      window,
+		wsPolicy:      policy,
+		wsTimeout:     time.Duration(timeout) * time.Second,
+		proxies:       proxies,
+		limits:        limits}
+	queueDepth.Store(func() int {
+		f.mutex.Lock()
+		defer f.mutex.Unlock()
+		return len(f.out)
+	})
+	return f
 }
 
 func (f *Forwarder) ForwardHTTP(ctx context.Context, w http.ResponseWriter, r *http.Request) {
 	if f.bridge == nil {
-		http2.WriteErr(w, r, errors2.ErrInternal)
+		http2.WriteErr(w, r, reqErr(errBridgeDisconnected))
 		return
 	}
 
@@ -57,23 +156,36 @@ func (f *Forwarder) ForwardHTTP(ctx context.Context, w http.ResponseWriter, r *h
 		return
 	}
 
+	if !f.limits.limit(r) {
+		http2.WriteErr(w, r, errors2.ErrPayloadTooLarge)
+		return
+	}
 	args, err := proto.MakeHTTPReqArgs(ctx, r)
-	if err != nil {
+	if errors.Is(err, flow.ErrTooLarge) {
+		http2.WriteErr(w, r, errors2.ErrPayloadTooLarge)
+		return
+	} else if err != nil {
 		http2.WriteErr(w, r, errors2.ErrBadRequest)
 		return
 	}
+	f.proxies.resolve(r, args)
 
-	resp, err := f.req(ctx, proto.HTTP, args)
+	resp, err := f.reqStream(ctx, proto.HTTP, args, nil, func(info *proto.Args) {
+		writeInfo(w, info)
+	})
 	if err != nil {
-		http2.WriteErr(w, r, errors2.ErrInternal)
+		if ctx.Err() != nil {
+			f.cancel(ctx)
+		}
+		http2.WriteErr(w, r, reqErr(err))
 		return
 	}
 
-	w.WriteHeader(int(resp.StatusCode))
-	for k, v := range resp.Headers {
-		w.Header()[k] = v
+	if resp.Stream {
+		f.forwardStream(ctx, w, r, resp)
+		return
 	}
-	w.Write(resp.Body)
+	writeResponse(ctx, w, r, resp)
 }
 
 func (f *Forwarder) ForwardOpenWebsocket(ctx context.Context, r *http.Request, ws *websocket.Conn) (string, error) {
@@ -90,7 +202,9 @@ func (f *Forwarder) ForwardOpenWebsocket(ctx context.Context, r *http.Request, w
 	if err != nil {
 		return "", err
 	}
+	f.proxies.resolve(r, args)
 	args.WSID = wsID
+	args.Credit = f.wsWindow
 	resp, err := f.req(ctx, proto.OPEN_WEBSOCKET, args)
 	if err != nil {
 		return "", err
@@ -99,8 +213,9 @@ func (f *Forwarder) ForwardOpenWebsocket(ctx context.Context, r *http.Request, w
 		logger.Warnf("failed to open websocket error[%v]", resp.Exception)
 		return "", fmt.Errorf(resp.Exception)
 	}
+	c := f.newClient(ctx, wsID, ws)
 	f.mutex.Lock()
-	f.wss[wsID] = ws
+	f.wss[wsID] = c
 	f.mutex.Unlock()
 	return wsID, nil
 }
@@ -119,18 +234,22 @@ func (f *Forwarder) ForwardWebsocketMsg(ctx context.Context, wsID string, ws *we
 }
 
 func (f *Forwarder) ForwardCloseWebsocket(ctx context.Context, wsID string, ws *websocket.Conn) error {
-	if f.bridge == nil {
-		return fmt.Errorf("invalid")
-	}
-
 	f.mutex.Lock()
-	if _, ok := f.wss[wsID]; !ok {
+	c, ok := f.wss[wsID]
+	if !ok {
 		f.mutex.Unlock()
 		return nil
 	}
 	delete(f.wss, wsID)
 	f.mutex.Unlock()
+	// the client is gone, no point to drain its queue
+	c.ws.Close()
+	c.close()
+	<-c.done
 
+	if f.bridge == nil {
+		return fmt.Errorf("invalid")
+	}
 	_, err := f.req(ctx, proto.CLOSE_WEBSOCKET, &proto.Args{WSID: wsID})
 	return err
 }
@@ -145,15 +264,62 @@ func (f *Forwarder) Serve(ctx context.Context, bridgingToken string, ws *websock
 		return
 	}
 
-	if bridgingToken != f.bridgingToken {
-		logger.Infof("invalid bridge token client[%s]", client)
+	if err := f.authenticate(bridgingToken, ws); err != nil {
+		logger.Infof("failed to authenticate bridge client[%s] error[%v]", client, err)
 		return
 	}
+	var session *seal.Session
+	if f.sealKeys != nil {
+		var err error
+		if session, err = f.startSession(ws); err != nil {
+			logger.Infof("failed to start sealed session client[%s] error[%v]", client, err)
+			return
+		}
+	}
 
+	out := make(chan sendItem, f.outSize)
+	stop := make(chan struct{})
+	connected, disconnect := context.WithCancel(context.Background())
+	f.mutex.Lock()
+	if f.bridge != nil {
+		// another bridge connected while this one was authenticating
+		f.mutex.Unlock()
+		disconnect()
+		logger.Infof("duplicate bridge ws connection client[%s]", client)
+		return
+	}
 	f.bridge = ws
+	f.out = out
+	f.connected = connected
+	f.mutex.Unlock()
+	go f.flush(ws, session, out, stop)
 	defer func() {
 		logger.Info("bridge is disconnected")
+		f.mutex.Lock()
 		f.bridge = nil
+		f.out = nil
+		f.connected = nil
+		// the requests waiting for a result get none from gateway anymore
+		for corrID, c := range f.reqs {
+			delete(f.reqs, corrID)
+			select {
+			case c <- &proto.Args{StatusCode: http.StatusServiceUnavailable, Exception: errBridgeDisconnected.Error()}:
+			default:
+			}
+		}
+		// gateway sends no more of the streams in flight, they end as truncated
+		for corrID, q := range f.streams {
+			q.Close()
+			delete(f.streams, corrID)
+		}
+		// the tunnels end with the bridge, both ways
+		for tcpID, tc := range f.tcps {
+			tc.close()
+			delete(f.tcps, tcpID)
+		}
+		f.mutex.Unlock()
+		disconnect()
+		close(stop)
 	}()
 
 	for {
@@ -167,6 +333,14 @@ func (f *Forwarder) Serve(ctx context.Context, bridgingToken string, ws *websock
 			logger.Infof("drop msg type[%d]", msgType)
 			continue
 		}
+		if session != nil {
+			if buf, err = session.Open(buf); err != nil {
+				// the packets after it cannot be trusted either
+				sealRejected.Add(1)
+				logger.Warnf("rejected packet from gateway, disconnecting error[%v]", err)
+				break
+			}
+		}
 		packet, err := proto.Deserialize(ctx, buf)
 		if err != nil {
 			continue
@@ -178,49 +352,99 @@ func (f *Forwarder) Serve(ctx context.Context, bridgingToken string, ws *websock
 			logger2.Infof("recv [%v]", packet)
 			wsID := packet.Args.WSID
 			f.mutex.Lock()
-			ws, ok := f.wss[wsID]
+			c, ok := f.wss[wsID]
 			if ok {
 				delete(f.wss, wsID)
 			}
 			f.mutex.Unlock()
 			if ok {
-				ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""), time.Now().Add(time.Second*3))
-				ws.Close()
+				c.close()
 			}
 		} else if packet.Method == proto.WEBSOCKET_MSG {
 			logger2.Debugf("recv [%v]", packet)
 			wsID := packet.Args.WSID
 			f.mutex.Lock()
-			ws, ok := f.wss[wsID]
+			c, ok := f.wss[wsID]
+			f.mutex.Unlock()
+			if ok {
+				f.push(common.CtxWithCorrID(ctx, packet.CorrID), wsID, c, []byte(packet.Args.Msg))
+			}
+		} else if packet.Method == proto.TCP_DATA || packet.Method == proto.TCP_ACK || packet.Method == proto.CLOSE_TCP {
+			logger2.Debugf("recv [%v]", packet)
+			f.handleTCP(ctx, packet)
+		} else if packet.Method == proto.HTTP_INFO {
+			logger2.Infof("recv [%v]", packet)
+			f.mutex.Lock()
+			ch, ok := f.infos[packet.CorrID]
 			f.mutex.Unlock()
 			if ok {
-				ws.WriteMessage(websocket.TextMessage, []byte(packet.Args.Msg))
+				// informational only, dropped if the requester is not keeping up
+				select {
+				case ch <- packet.Args:
+				default:
+				}
+			}
+		} else if packet.Method == proto.HTTP_BODY {
+			logger2.Debugf("recv [%v]", packet)
+			f.mutex.Lock()
+			q, ok := f.streams[packet.CorrID]
+			f.mutex.Unlock()
+			if ok {
+				if _, err := q.Push(packet.Args); err == flow.ErrOverflow {
+					logger2.Warnf("slow client, aborting stream")
+					q.Close()
+				}
 			}
 		} else {
 			logger2.Infof("recv [%v]", packet)
 
 			f.mutex.Lock()
 			ch, ok := f.reqs[packet.CorrID]
+			delete(f.reqs, packet.CorrID)
+			if ok && packet.Method == proto.HTTP_RESULT && packet.Args.Stream {
+				// created before the head is delivered, so that no body is missed
+				f.streams[packet.CorrID] = flow.NewQueue(int(f.streamSize), flow.PolicyDisconnect)
+			}
 			f.mutex.Unlock()
 			if ok {
-				ch <- packet.Args
-				close(ch)
+				// ch is buffered, the requester may have given up already
+				select {
+				case ch <- packet.Args:
+				default:
+					f.mutex.Lock()
+					delete(f.streams, packet.CorrID)
+					f.mutex.Unlock()
+				}
 			}
 		}
 	}
 }
 
 func (f *Forwarder) req(ctx context.Context, method proto.PacketMethod, args *proto.Args) (*proto.Args, error) {
+	return f.reqStream(ctx, method, args, nil, nil)
+}
+
+// reqStream sends the request and waits for the result, body is streamed after the request if not nil.
+// onInfo if not nil is called with each 1xx response before the result, in the caller goroutine.
+func (f *Forwarder) reqStream(ctx context.Context, method proto.PacketMethod, args *proto.Args, body io.Reader, onInfo func(*proto.Args)) (*proto.Args, error) {
 	_, corrID := common.CorrIDCtx(ctx)
-	c := make(chan *proto.Args)
+	c := make(chan *proto.Args, 1)
+	var infos chan *proto.Args
+	if onInfo != nil {
+		infos = make(chan *proto.Args, 8)
+	}
 
 	f.mutex.Lock()
 	f.reqs[corrID] = c
+	if infos != nil {
+		f.infos[corrID] = infos
+	}
 	f.mutex.Unlock()
 
 	defer func() {
 		f.mutex.Lock()
 		delete(f.reqs, corrID)
+		delete(f.infos, corrID)
 		f.mutex.Unlock()
 	}()
 
@@ -228,25 +452,109 @@ func (f *Forwarder) req(ctx context.Context, method proto.PacketMethod, args *pr
 	if err := f.send(ctx, &p); err != nil {
 		return nil, err
 	}
+	if body != nil {
+		go f.sendBody(ctx, body)
+	}
+
+	return awaitResult(ctx, c, infos, onInfo)
+}
+
+// reqErr maps the error of a request to the one replied to the client, 503 if the packet could not be queued
+// so that the client may retry later.
+func reqErr(err error) errors2.CodeMsgData {
+	if errors.Is(err, errSendQueueFull) || errors.Is(err, errBridgeDisconnected) {
+		return errors2.ErrUnavailable
+	}
+	return errors2.ErrInternal
+}
 
-	return <-c, nil
+// awaitResult waits for the result, calling onInfo with each 1xx response meanwhile. Gateway sends the 1xx
+// responses before the result, so those still queued when the result arrives are delivered first.
+func awaitResult(ctx context.Context, c chan *proto.Args, infos chan *proto.Args, onInfo func(*proto.Args)) (*proto.Args, error) {
+	for {
+		select {
+		case info := <-infos:
+			onInfo(info)
+		case resp := <-c:
+			for {
+				select {
+				case info := <-infos:
+					onInfo(info)
+				default:
+					return resp, nil
+				}
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
 }
 
+// send queues the packet for bridge without blocking, it fails if the queue is full.
 func (f *Forwarder) send(ctx context.Context, p *proto.Packet) error {
 	logger := log.Ctx(ctx)
-	w, err := gzip.NewWriterLevel(ioutil.Discard, int(f.compressLevel))
-	if err != nil {
-		logger.Warnf("failed to create gzip writer error[%v]", err)
-		return err
+	f.mutex.Lock()
+	out := f.out
+	f.mutex.Unlock()
+	if out == nil {
+		return errBridgeDisconnected
 	}
-	msg, err := p.Serialize(ctx, w)
-	if err != nil {
-		return err
+
+	select {
+	case out <- sendItem{ctx: ctx, packet: p, queued: time.Now()}:
+		sendEnqueued.Add(1)
+		return nil
+	default:
+		sendRejected.Add(1)
+		logger.Warnf("failed to send [%s] error[%v]", p, errSendQueueFull)
+		return errSendQueueFull
 	}
-	logger.Infof("send [%s]", p)
-	err = f.bridge.WriteMessage(websocket.BinaryMessage, msg)
-	if err != nil {
-		logger.Warnf("failed to send error[%v]", err)
+}
+
+// sendWait queues the packet like send, but waits for room until ctx is done, for packets which must not be lost
+// and are not sent from the read loop.
+func (f *Forwarder) sendWait(ctx context.Context, p *proto.Packet) error {
+	f.mutex.Lock()
+	out := f.out
+	f.mutex.Unlock()
+	if out == nil {
+		return errBridgeDisconnected
+	}
+
+	select {
+	case out <- sendItem{ctx: ctx, packet: p, queued: time.Now()}:
+		sendEnqueued.Add(1)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// flush is the only writer of the bridge websocket, it sends the queued packets with a reused compressor,
+// sealed if session is not nil.
+func (f *Forwarder) flush(ws *websocket.Conn, session *seal.Session, out chan sendItem, stop chan struct{}) {
+	compressor, _ := gzip.NewWriterLevel(ioutil.Discard, int(f.compressLevel))
+	for {
+		select {
+		case <-stop:
+			return
+		case item := <-out:
+			sendLatency.Observe(float64(time.Since(item.queued)) / float64(time.Millisecond))
+			logger := log.Ctx(item.ctx)
+			msg, err := item.packet.Serialize(item.ctx, compressor)
+			if err != nil {
+				continue
+			}
+			if session != nil {
+				if msg, err = session.Seal(msg); err != nil {
+					logger.Warnf("failed to seal error[%v]", err)
+					continue
+				}
+			}
+			logger.Infof("send [%s]", item.packet)
+			if err := ws.WriteMessage(websocket.BinaryMessage, msg); err != nil {
+				logger.Warnf("failed to send error[%v]", err)
+			}
+		}
 	}
-	return err
 }
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+)
+
+// geoIP maps addresses to countries with a local csv database, each row is either <cidr>,<country>
+// or <first ip>,<last ip>,<country> as in the DB-IP lite csv. Rows which do not parse, e.g. a header, are skipped.
+type geoIP struct {
+	ranges []geoRange // by first ip
+}
+
+type geoRange struct {
+	first   net.IP // 16 bytes
+	last    net.IP
+	country string
+}
+
+func loadGeoIP(file string) (*geoIP, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	r.ReuseRecord = true
+	g := &geoIP{}
+	for {
+		row, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if rg, ok := parseGeoRow(row); ok {
+			g.ranges = append(g.ranges, rg)
+		}
+	}
+	if len(g.ranges) == 0 {
+		return nil, fmt.Errorf("no ranges found")
+	}
+	sort.Slice(g.ranges, func(i, j int) bool { return bytes.Compare(g.ranges[i].first, g.ranges[j].first) < 0 })
+	return g, nil
+}
+
+func parseGeoRow(row []string) (geoRange, bool) {
+	switch len(row) {
+	case 2:
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(row[0]))
+		if err != nil {
+			return geoRange{}, false
+		}
+		first := ipNet.IP.Mask(ipNet.Mask)
+		last := make(net.IP, len(first))
+		for i := range first {
+			last[i] = first[i] | ^ipNet.Mask[i]
+		}
+		return geoRange{first: first.To16(), last: last.To16(), country: strings.ToUpper(strings.TrimSpace(row[1]))}, true
+	case 3:
+		first := net.ParseIP(strings.TrimSpace(row[0]))
+		last := net.ParseIP(strings.TrimSpace(row[1]))
+		if first == nil || last == nil {
+			return geoRange{}, false
+		}
+		return geoRange{first: first.To16(), last: last.To16(), country: strings.ToUpper(strings.TrimSpace(row[2]))}, true
+	}
+	return geoRange{}, false
+}
+
+// country returns the country code of ip, empty if it is unknown.
+func (g *geoIP) country(ip net.IP) string {
+	ip = ip.To16()
+	// the last range which starts at or before ip
+	i := sort.Search(len(g.ranges), func(i int) bool { return bytes.Compare(g.ranges[i].first, ip) > 0 }) - 1
+	if i >= 0 && bytes.Compare(ip, g.ranges[i].last) <= 0 {
+		return g.ranges[i].country
+	}
+	return ""
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/library/common"
+	errors2 "github.com/bcmmacro/bridging-go/library/errors"
+	http2 "github.com/bcmmacro/bridging-go/library/http"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+func isGRPC(r *http.Request) bool {
+	return r.ProtoMajor == 2 && strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc")
+}
+
+// ForwardGRPC forwards a gRPC call, request and response messages are streamed both ways at the same time.
+func (f *Forwarder) ForwardGRPC(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	if f.bridge == nil {
+		http2.WriteErr(w, r, reqErr(errBridgeDisconnected))
+		return
+	}
+
+	if r.Header.Get("bridging-base-url") == "" {
+		http2.WriteErr(w, r, errors2.ErrBadRequest)
+		return
+	}
+
+	// the body is streamed, an oversized one is aborted once the limit is reached
+	if !f.limits.limit(r) {
+		http2.WriteErr(w, r, errors2.ErrPayloadTooLarge)
+		return
+	}
+	args := proto.MakeStreamReqArgs(r)
+	f.proxies.resolve(r, args)
+	resp, err := f.reqStream(ctx, proto.GRPC, args, r.Body, nil)
+	if err != nil {
+		if ctx.Err() != nil {
+			f.cancel(ctx)
+		}
+		http2.WriteErr(w, r, reqErr(err))
+		return
+	}
+
+	if resp.Stream {
+		f.forwardStream(ctx, w, r, resp)
+		return
+	}
+	// trailers-only response, e.g. an error
+	writeResponse(ctx, w, r, resp)
+}
+
+// sendBody streams the request body to gateway in http_body packets, until EOF or the call ends.
+func (f *Forwarder) sendBody(ctx context.Context, body io.Reader) {
+	_, corrID := common.CorrIDCtx(ctx)
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := body.Read(buf)
+		if n > 0 {
+			data := append([]byte(nil), buf[:n]...)
+			// waits while the send queue is full, which holds back the client through tcp. It fails only once
+			// the call or the bridge is gone, then nothing more can reach gateway for this call anyway.
+			if err := f.sendWait(ctx, &proto.Packet{CorrID: corrID, Method: proto.HTTP_BODY, Args: &proto.Args{Body: data}}); err != nil {
+				log.Ctx(ctx).Warnf("failed to send request body error[%v]", err)
+				return
+			}
+		}
+		if err != nil {
+			args := &proto.Args{EOF: true}
+			if err != io.EOF {
+				log.Ctx(ctx).Warnf("failed to read request body error[%v]", err)
+				args.Exception = err.Error()
+			}
+			if err := f.sendWait(ctx, &proto.Packet{CorrID: corrID, Method: proto.HTTP_BODY, Args: args}); err != nil {
+				log.Ctx(ctx).Warnf("failed to end request body error[%v]", err)
+			}
+			return
+		}
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/rs/cors"
 
+	"github.com/bcmmacro/bridging-go/internal/auth"
 	"github.com/bcmmacro/bridging-go/library/common"
 	errors2 "github.com/bcmmacro/bridging-go/library/errors"
 	http2 "github.com/bcmmacro/bridging-go/library/http"
@@ -15,10 +16,14 @@ import (
 type Handler struct {
 	forwarder *Forwarder
 	upgrader  *websocket.Upgrader
+	limiter   *rateLimiter
+	auth      *clientAuth // nil if clients are not authenticated
+	access    *accessRules
+	mTLS      bool // gateway must present a client certificate on /bridge
 }
 
-func NewHandler(corsCheck *cors.Cors) *Handler {
-	return &Handler{forwarder: NewForwarder(), upgrader: &websocket.Upgrader{
+func NewHandler(corsCheck *cors.Cors, limiter *rateLimiter, clientAuth *clientAuth, access *accessRules) *Handler {
+	return &Handler{forwarder: NewForwarder(), limiter: limiter, auth: clientAuth, access: access, upgrader: &websocket.Upgrader{
 		CheckOrigin: func(r *http.Request) bool {
 			if r.URL.Path == "/bridge" {
 				return true
@@ -31,7 +36,56 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx, logger := common.CorrIDCtxLogger(r.Context())
 	logger.Infof("recv %s %s %s", r.Method, r.RemoteAddr, r.URL.String())
 
+	if err := h.access.check(r, h.forwarder.proxies); err != nil {
+		logger.Warnf("forbidden error[%v]", err)
+		accessDenied.Add(1)
+		http2.WriteErr(w, r, errors2.ErrForbidden)
+		return
+	}
+
 	isWebsocket := r.Header.Get("Upgrade") == "websocket"
+	// /bridge only serves the websocket of gateway, which is authenticated once upgraded, any other request
+	// there would be forwarded without the checks below
+	isBridge := r.URL.Path == "/bridge"
+	if isBridge && !isWebsocket {
+		logger.Warnf("not a websocket upgrade on /bridge from %s", r.RemoteAddr)
+		http2.WriteErr(w, r, errors2.ErrNotFound)
+		return
+	}
+
+	// requests and websocket connections from the public are throttled, gateway is not
+	if !isBridge {
+		if ok, wait := h.limiter.allow(r, h.forwarder.proxies); !ok {
+			logger.Warnf("rate limited, retry after %v", wait)
+			writeTooManyRequests(w, r, wait)
+			return
+		}
+
+		// only bridge sets the identity headers, after it authenticates the client
+		auth.StripIdentity(r.Header)
+		if h.auth != nil {
+			id, err := h.auth.authenticate(r)
+			if err != nil {
+				logger.Warnf("failed to authenticate client error[%v]", err)
+				if challenge := h.auth.challenge(); challenge != "" {
+					w.Header().Set("WWW-Authenticate", challenge)
+				}
+				http2.WriteErr(w, r, errors2.ErrUnauthorized)
+				return
+			}
+			if id != nil {
+				_, corrID := common.CorrIDCtx(ctx)
+				auth.SignIdentity(r.Header, *id, requestOf(corrID, r, isWebsocket), h.auth.keyID, h.auth.key, time.Now())
+			}
+		}
+	}
+
+	if isBridge && h.mTLS && !verifiedClient(r) {
+		logger.Warnf("no verified client certificate from %s", r.RemoteAddr)
+		http2.WriteErr(w, r, errors2.ErrUnauthorized)
+		return
+	}
+
 	if isWebsocket {
 		conn, err := h.upgrader.Upgrade(w, r, nil)
 		if err != nil {
@@ -46,7 +100,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			logger.Infof("closed websocket")
 		}()
 
-		if r.URL.Path == "/bridge" {
+		if isBridge {
 			// here uses HTTP headers, which supports more character set compared to HTTP query param.
 			bridgingToken := r.Header.Get("bridging-token")
 			h.forwarder.Serve(ctx, bridgingToken, conn)
@@ -55,6 +109,7 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				logger.Warnf("failed to open websocket error[%v]", err)
 			} else {
+				bucket := h.limiter.msgBucket()
 				for {
 					msgType, msg, err := conn.ReadMessage()
 					ctx, logger = common.CorrIDCtxLogger(r.Context())
@@ -63,7 +118,15 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 						break
 					}
 					if msgType == websocket.BinaryMessage || msgType == websocket.TextMessage {
-						h.forwarder.ForwardWebsocketMsg(ctx, wsID, conn, msg)
+						// messages over the rate are held back, which slows down the client through tcp
+						if bucket != nil && bucket.Wait(ctx) != nil {
+							break
+						}
+						// a lost message would leave both ends out of step, so the websocket is closed instead
+						if err := h.forwarder.ForwardWebsocketMsg(ctx, wsID, conn, msg); err != nil {
+							logger.Warnf("failed to forward websocket message error[%v]", err)
+							break
+						}
 					} else {
 						logger.Infof("drop message type[%d]", msgType)
 					}
@@ -71,6 +134,8 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				h.forwarder.ForwardCloseWebsocket(ctx, wsID, conn)
 			}
 		}
+	} else if isGRPC(r) {
+		h.forwarder.ForwardGRPC(ctx, w, r)
 	} else {
 		h.forwarder.ForwardHTTP(ctx, w, r)
 	}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// jwksRefreshInterval is how often the JWKS is fetched again, a token signed by an unknown key fetches it sooner.
+	jwksRefreshInterval = 5 * time.Minute
+	jwksMinInterval     = 10 * time.Second
+	// jwksUnknownTTL is how long a kid which the JWKS did not have does not fetch it again.
+	jwksUnknownTTL = time.Minute
+	// jwtLeeway tolerates the clock skew between bridge and the issuer.
+	jwtLeeway = time.Minute
+)
+
+var errUnknownJWK = errors.New("unknown jwk")
+
+// jwtVerifier verifies JWTs signed with RS256/384/512 or ES256/384/512 by the keys of a JWKS,
+// read from a file or fetched from an endpoint.
+type jwtVerifier struct {
+	jwks     string // file or http(s) url of the JWKS
+	issuer   string // required iss, any if empty
+	audience string // required in aud, any if empty
+	client   *http.Client
+	mutex    sync.Mutex
+	keys     map[string]crypto.PublicKey // by kid
+	fetched  time.Time
+	fetching chan struct{}        // closed once the JWKS being fetched is loaded, nil if none is
+	unknown  map[string]time.Time // kids not in the JWKS when it was fetched, and when
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func newJWTVerifier(jwks string, issuer string, audience string) (*jwtVerifier, error) {
+	v := &jwtVerifier{jwks: jwks, issuer: issuer, audience: audience, client: &http.Client{Timeout: 10 * time.Second}, unknown: map[string]time.Time{}}
+	keys, err := v.load()
+	if err != nil {
+		return nil, err
+	}
+	v.keys, v.fetched = keys, time.Now()
+	return v, nil
+}
+
+func (v *jwtVerifier) read() ([]byte, error) {
+	if !strings.HasPrefix(v.jwks, "http://") && !strings.HasPrefix(v.jwks, "https://") {
+		return ioutil.ReadFile(v.jwks)
+	}
+	resp, err := v.client.Get(v.jwks)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("jwks status[%d]", resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// load reads the JWKS, keys of an unsupported type are skipped.
+func (v *jwtVerifier) load() (map[string]crypto.PublicKey, error) {
+	data, err := v.read()
+	if err != nil {
+		return nil, err
+	}
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(data, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			logrus.Warnf("skipped jwk kid[%s] error[%v]", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = key
+	}
+	return keys, nil
+}
+
+// refresh fetches the JWKS without holding the mutex, unless it is being fetched already. It returns a channel
+// which is closed once the JWKS is loaded. The caller holds the mutex.
+func (v *jwtVerifier) refresh() chan struct{} {
+	if v.fetching != nil {
+		return v.fetching
+	}
+	done := make(chan struct{})
+	v.fetching, v.fetched = done, time.Now()
+	go func() {
+		keys, err := v.load()
+		v.mutex.Lock()
+		if err != nil {
+			logrus.Errorf("failed to refresh jwks error[%v]", err)
+		} else {
+			v.keys = keys
+		}
+		for kid, at := range v.unknown {
+			if time.Since(at) >= jwksUnknownTTL {
+				delete(v.unknown, kid)
+			}
+		}
+		v.fetching = nil
+		v.mutex.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+func decodeInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(b), nil
+}
+
+func (k *jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, present := curves[k.Crv]
+		if !present {
+			return nil, fmt.Errorf("unsupported curve[%s]", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported kty[%s]", k.Kty)
+}
+
+// key returns the key of kid. A stale JWKS is fetched again in the background, and one which does not have kid
+// is fetched again at most every jwksMinInterval, and not for a kid it did not have within jwksUnknownTTL.
+func (v *jwtVerifier) key(kid string) (crypto.PublicKey, error) {
+	v.mutex.Lock()
+	key, present := v.keys[kid]
+	since := time.Since(v.fetched)
+	var fetched chan struct{}
+	if since >= jwksRefreshInterval || (!present && since >= jwksMinInterval && time.Since(v.unknown[kid]) >= jwksUnknownTTL) {
+		fetched = v.refresh()
+	}
+	v.mutex.Unlock()
+	if present {
+		return key, nil
+	}
+	if fetched == nil {
+		return nil, errUnknownJWK
+	}
+
+	<-fetched
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if key, present = v.keys[kid]; !present {
+		v.unknown[kid] = time.Now()
+		return nil, errUnknownJWK
+	}
+	return key, nil
+}
+
+var jwtHashes = map[string]crypto.Hash{
+	"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+	"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+}
+
+// verify checks the signature and the registered claims of the token, and returns its claims.
+func (v *jwtVerifier) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, err
+	}
+	hash, present := jwtHashes[header.Alg]
+	if !present {
+		return nil, fmt.Errorf("unsupported alg[%s]", header.Alg)
+	}
+	key, err := v.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write([]byte(parts[0] + "." + parts[1]))
+	if err := verifySignature(key, header.Alg, hash, h.Sum(nil), sig); err != nil {
+		return nil, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(jwtLeeway)) {
+		return nil, errors.New("expired jwt")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(jwtLeeway).Before(time.Unix(int64(nbf), 0)) {
+		return nil, errors.New("jwt not valid yet")
+	}
+	if v.issuer != "" && claims["iss"] != v.issuer {
+		return nil, fmt.Errorf("unexpected iss[%v]", claims["iss"])
+	}
+	if v.audience != "" && !containsString(stringsOf(claims["aud"]), v.audience) {
+		return nil, fmt.Errorf("unexpected aud[%v]", claims["aud"])
+	}
+	return claims, nil
+}
+
+func decodeSegment(seg string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func verifySignature(key crypto.PublicKey, alg string, hash crypto.Hash, digest []byte, sig []byte) error {
+	switch k := key.(type) {
+	case *rsa.PublicKey:
+		if alg[:2] != "RS" {
+			return fmt.Errorf("alg[%s] does not match rsa key", alg)
+		}
+		return rsa.VerifyPKCS1v15(k, hash, digest, sig)
+	case *ecdsa.PublicKey:
+		size := (k.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(sig) != 2*size {
+			return fmt.Errorf("alg[%s] does not match ec key", alg)
+		}
+		r := new(big.Int).SetBytes(sig[:size])
+		s := new(big.Int).SetBytes(sig[size:])
+		if !ecdsa.Verify(k, digest, r, s) {
+			return errors.New("invalid jwt signature")
+		}
+		return nil
+	}
+	return errors.New("unsupported key")
+}
+
+// stringsOf reads a claim which is either a string or an array of strings.
+func stringsOf(claim interface{}) []string {
+	switch c := claim.(type) {
+	case string:
+		return []string{c}
+	case []interface{}:
+		var ret []string
+		for _, v := range c {
+			if s, ok := v.(string); ok {
+				ret = append(ret, s)
+			}
+		}
+		return ret
+	}
+	return nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
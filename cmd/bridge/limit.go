@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/bcmmacro/bridging-go/internal/flow"
+)
+
+// bodyLimits caps the size of request bodies from clients, per path prefix with a global fallback.
+type bodyLimits struct {
+	global int64
+	routes []routeLimit // longest prefix first
+}
+
+type routeLimit struct {
+	prefix string
+	size   int64
+}
+
+// parseBodyLimits parses the global limit and per route limits like "/upload=104857600,/api=65536".
+func parseBodyLimits(global string, routes string) (bodyLimits, error) {
+	ret := bodyLimits{global: 10 << 20}
+	if global != "" {
+		size, err := strconv.ParseInt(global, 10, 64)
+		if err != nil {
+			return ret, fmt.Errorf("invalid max body size[%s]", global)
+		}
+		ret.global = size
+	}
+	for _, m := range strings.Split(routes, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		parts := strings.Split(m, "=")
+		if len(parts) != 2 || !strings.HasPrefix(parts[0], "/") {
+			return ret, fmt.Errorf("invalid route max body size[%s]", m)
+		}
+		size, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		if err != nil {
+			return ret, fmt.Errorf("invalid route max body size[%s]", m)
+		}
+		ret.routes = append(ret.routes, routeLimit{prefix: strings.TrimSpace(parts[0]), size: size})
+	}
+	sort.Slice(ret.routes, func(i, j int) bool { return len(ret.routes[i].prefix) > len(ret.routes[j].prefix) })
+	return ret, nil
+}
+
+// of returns the limit of the request, 0 or less means unlimited.
+func (l bodyLimits) of(r *http.Request) int64 {
+	for _, route := range l.routes {
+		if underPrefix(r.URL.Path, route.prefix) {
+			return route.size
+		}
+	}
+	return l.global
+}
+
+// limit caps the request body, false if the declared Content-Length is over the limit already.
+func (l bodyLimits) limit(r *http.Request) bool {
+	size := l.of(r)
+	if size > 0 && r.ContentLength > size {
+		return false
+	}
+	r.Body = flow.LimitBody(r.Body, size)
+	return true
+}
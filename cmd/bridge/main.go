@@ -9,8 +9,11 @@ import (
 	"github.com/joho/godotenv"
 	"github.com/rs/cors"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	_ "github.com/bcmmacro/bridging-go/library/log"
+	"github.com/bcmmacro/bridging-go/library/metrics"
 )
 
 func main() {
@@ -25,12 +28,62 @@ func main() {
 		AllowedMethods:     strings.Split(os.Getenv("BRIDGE_CORS_ALLOW_METHODS"), ","),
 		AllowedHeaders:     strings.Split(os.Getenv("BRIDGE_CORS_ALLOW_HEADERS"), ","),
 	})
-	handler := NewHandler(c)
+	limiter, err := newRateLimiter()
+	if err != nil {
+		logrus.Fatalf("failed to parse rate limits error[%v]", err)
+	}
+	clientAuth, err := newClientAuth()
+	if err != nil {
+		logrus.Fatalf("failed to load client authentication error[%v]", err)
+	}
+	if err := limiter.useAPIKeys(clientAuth); err != nil {
+		logrus.Fatalf("failed to parse rate limits error[%v]", err)
+	}
+	access, err := newAccessRules()
+	if err != nil {
+		logrus.Fatalf("failed to load access rules error[%v]", err)
+	}
+	handler := NewHandler(c, limiter, clientAuth, access)
+	if handler.forwarder == nil {
+		logrus.Fatalf("failed to parse forwarder config, see BRIDGE_* in the env file")
+	}
+
+	if addr := os.Getenv("BRIDGE_METRICS_ADDR"); addr != "" {
+		metrics.Serve(addr)
+	}
+
+	tcpListen, err := ParseTCPListen(os.Getenv("BRIDGE_TCP_LISTEN"))
+	if err != nil {
+		logrus.Fatalf("failed to parse BRIDGE_TCP_LISTEN error[%v]", err)
+	}
+	for addr, target := range tcpListen {
+		if err := handler.forwarder.ListenTCP(addr, target, access); err != nil {
+			logrus.Fatalf("failed to listen tcp addr[%s] error[%v]", addr, err)
+		}
+		logrus.Infof("listening tcp %s -> %s", addr, target)
+	}
 
 	port := ":8000"
 	if portEnv := os.Getenv("PORT"); portEnv != "" {
 		port = fmt.Sprintf(":%s", os.Getenv("PORT"))
 	}
-	logrus.Infof("listening on port %s", port)
-	logrus.Fatal(http.ListenAndServe(port, c.Handler(handler)))
+	tlsConfig, manager, err := newTLSConfig()
+	if err != nil {
+		logrus.Fatalf("failed to load tls config error[%v]", err)
+	}
+	// h2c accepts cleartext HTTP/2 for gRPC, HTTP/1 requests pass through
+	server := &http.Server{Addr: port, Handler: h2c.NewHandler(c.Handler(handler), &http2.Server{}), TLSConfig: tlsConfig}
+	if tlsConfig == nil {
+		logrus.Infof("listening on port %s", port)
+		logrus.Fatal(server.ListenAndServe())
+	}
+	handler.mTLS = tlsConfig.ClientCAs != nil
+	if redirectPort := os.Getenv("BRIDGE_HTTP_REDIRECT_PORT"); redirectPort != "" {
+		go func() {
+			logrus.Infof("redirecting http to https on port :%s", redirectPort)
+			logrus.Fatal(http.ListenAndServe(":"+redirectPort, redirectHandler(manager, strings.TrimPrefix(port, ":"))))
+		}()
+	}
+	logrus.Infof("listening on port %s with tls, mtls on /bridge[%v]", port, handler.mTLS)
+	logrus.Fatal(server.ListenAndServeTLS("", ""))
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"expvar"
+	"sync/atomic"
+
+	"github.com/bcmmacro/bridging-go/library/metrics"
+)
+
+var (
+	sendEnqueued = expvar.NewInt("bridge_send_enqueued")
+	sendRejected = expvar.NewInt("bridge_send_rejected")
+	rateLimited  = expvar.NewInt("bridge_rate_limited")
+	sealRejected = expvar.NewInt("bridge_seal_rejected") // tampered or replayed packets from gateway
+	accessDenied = expvar.NewInt("bridge_access_denied")
+	// time a packet waits in the send queue before it is written to bridge
+	sendLatency = metrics.NewHistogram("bridge_send_queue_latency_ms", 1, 5, 10, 50, 100, 500, 1000, 5000)
+)
+
+// queueDepth is the depth of the send queue of the last forwarder made, a func() int. It is published once,
+// so that making another forwarder does not panic on publishing the same name again.
+var queueDepth atomic.Value
+
+func init() {
+	expvar.Publish("bridge_send_queue_depth", expvar.Func(func() interface{} {
+		if depth, ok := queueDepth.Load().(func() int); ok {
+			return depth()
+		}
+		return 0
+	}))
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bcmmacro/bridging-go/internal/proto"
+)
+
+// forwardedHeaders describe the original request, they are set by gateway and never passed on from client.
+var forwardedHeaders = []string{"Forwarded", "X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip"}
+
+// trustedProxies are the load balancers in front of bridge, whose X-Forwarded-* headers are trusted.
+type trustedProxies []*net.IPNet
+
+// parseTrustedProxies parses comma separated CIDRs or IPs.
+func parseTrustedProxies(s string) (trustedProxies, error) {
+	var ret trustedProxies
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+		ipNet, err := parseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, ipNet)
+	}
+	return ret, nil
+}
+
+// parseCIDR parses a CIDR, or an IP as a network of itself.
+func parseCIDR(v string) (*net.IPNet, error) {
+	if !strings.Contains(v, "/") {
+		if ip := net.ParseIP(v); ip != nil && ip.To4() != nil {
+			v += "/32"
+		} else {
+			v += "/128"
+		}
+	}
+	_, ipNet, err := net.ParseCIDR(v)
+	return ipNet, err
+}
+
+func (t trustedProxies) contains(ip net.IP) bool {
+	for _, ipNet := range t {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP strips the port from a remote address.
+func remoteIP(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// clientIP returns the address of the client, X-Forwarded-For is used only if the request
+// comes from a trusted proxy: the rightmost address which is not a trusted proxy is the client.
+func (t trustedProxies) clientIP(r *http.Request) string {
+	client := remoteIP(r.RemoteAddr)
+	ip := net.ParseIP(client)
+	if ip == nil || !t.contains(ip) {
+		return client
+	}
+	var xff []string
+	for _, v := range r.Header.Values("X-Forwarded-For") {
+		xff = append(xff, strings.Split(v, ",")...)
+	}
+	for i := len(xff) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(xff[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !t.contains(ip) {
+			break
+		}
+	}
+	return client
+}
+
+// resolve sets the client, scheme and host of the original request into args,
+// and removes the forwarded headers from client.
+func (t trustedProxies) resolve(r *http.Request, args *proto.Args) {
+	args.Client = t.clientIP(r)
+	if ip := net.ParseIP(remoteIP(r.RemoteAddr)); ip != nil && t.contains(ip) {
+		if scheme := r.Header.Get("X-Forwarded-Proto"); scheme == "http" || scheme == "https" {
+			args.Scheme = scheme
+		}
+		if host := r.Header.Get("X-Forwarded-Host"); host != "" {
+			args.Host = host
+		}
+	}
+	for _, h := range forwardedHeaders {
+		delete(args.Headers, h)
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/flow"
+	errors2 "github.com/bcmmacro/bridging-go/library/errors"
+	http2 "github.com/bcmmacro/bridging-go/library/http"
+)
+
+const (
+	rateKeyIP     = "ip"
+	rateKeyAPIKey = "api_key"
+	rateKeyRoute  = "route"
+)
+
+// rateLimiter throttles requests and websocket connections from the public with a token bucket per key,
+// and websocket messages with a token bucket per connection.
+type rateLimiter struct {
+	rate      float64 // requests per second per key, 0 means unlimited
+	burst     int
+	key       string
+	keyHeader string                     // header of the api key
+	subjectOf func(apiKey string) string // subject of a known api key, empty for any other key
+	msgRate   float64                    // websocket messages per second per connection, 0 means unlimited
+	msgBurst  int
+	mutex     sync.Mutex
+	buckets   map[string]*flow.Bucket
+}
+
+func parseRate(rate string, burst string) (float64, int, error) {
+	if rate == "" {
+		return 0, 0, nil
+	}
+	r, err := strconv.ParseFloat(rate, 64)
+	if err != nil || r < 0 {
+		return 0, 0, fmt.Errorf("invalid rate[%s]", rate)
+	}
+	b := int(math.Ceil(r))
+	if burst != "" {
+		if b, err = strconv.Atoi(burst); err != nil || b <= 0 {
+			return 0, 0, fmt.Errorf("invalid burst[%s]", burst)
+		}
+	}
+	return r, b, nil
+}
+
+// newRateLimiter makes a rate limiter from the BRIDGE_RATE_LIMIT* and BRIDGE_WS_MSG_* env.
+func newRateLimiter() (*rateLimiter, error) {
+	l := &rateLimiter{key: os.Getenv("BRIDGE_RATE_LIMIT_KEY"), keyHeader: os.Getenv("BRIDGE_RATE_LIMIT_API_KEY_HEADER"), buckets: map[string]*flow.Bucket{}}
+	var err error
+	if l.rate, l.burst, err = parseRate(os.Getenv("BRIDGE_RATE_LIMIT"), os.Getenv("BRIDGE_RATE_LIMIT_BURST")); err != nil {
+		return nil, err
+	}
+	if l.msgRate, l.msgBurst, err = parseRate(os.Getenv("BRIDGE_WS_MSG_RATE"), os.Getenv("BRIDGE_WS_MSG_BURST")); err != nil {
+		return nil, err
+	}
+	switch l.key {
+	case "":
+		l.key = rateKeyIP
+	case rateKeyIP, rateKeyAPIKey, rateKeyRoute:
+	default:
+		return nil, fmt.Errorf("invalid rate limit key[%s]", l.key)
+	}
+	if l.keyHeader == "" {
+		l.keyHeader = "X-Api-Key"
+	}
+	if l.rate > 0 {
+		go l.sweep()
+	}
+	return l, nil
+}
+
+// useAPIKeys gives the limiter the api keys of client authentication, limiting by api key needs them, otherwise
+// every request would fall back to its ip without any sign of it.
+func (l *rateLimiter) useAPIKeys(a *clientAuth) error {
+	if l.key == rateKeyAPIKey && (a == nil || a.apiKeys == nil) {
+		return fmt.Errorf("rate limit key[%s] needs the api keys of client authentication, set BRIDGE_AUTH_API_KEYS_FILE", l.key)
+	}
+	l.subjectOf = a.subjectOfAPIKey
+	return nil
+}
+
+// keyOf returns the bucket key of the request. Requests are limited before they are authenticated, so an api key
+// only has its own bucket if it is a known one, requests with any other key are limited by ip.
+func (l *rateLimiter) keyOf(r *http.Request, proxies trustedProxies) string {
+	switch l.key {
+	case rateKeyAPIKey:
+		if apiKey := r.Header.Get(l.keyHeader); apiKey != "" && l.subjectOf != nil {
+			if subject := l.subjectOf(apiKey); subject != "" {
+				return "key:" + subject
+			}
+		}
+	case rateKeyRoute:
+		netloc := r.Header.Get("bridging-base-url")
+		if netloc == "" {
+			netloc = r.URL.Query().Get("bridging-base-url")
+		}
+		return "route:" + netloc + r.URL.Path
+	}
+	return "ip:" + proxies.clientIP(r)
+}
+
+// allow takes a token for the request, otherwise returns how long the client should wait.
+func (l *rateLimiter) allow(r *http.Request, proxies trustedProxies) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	key := l.keyOf(r, proxies)
+	l.mutex.Lock()
+	b, present := l.buckets[key]
+	if !present {
+		b = flow.NewBucket(l.rate, l.burst)
+		l.buckets[key] = b
+	}
+	l.mutex.Unlock()
+	return b.Take()
+}
+
+// msgBucket makes the message bucket of a websocket, nil if messages are not limited.
+func (l *rateLimiter) msgBucket() *flow.Bucket {
+	if l.msgRate <= 0 {
+		return nil
+	}
+	return flow.NewBucket(l.msgRate, l.msgBurst)
+}
+
+// sweep drops refilled buckets, so that the buckets of clients gone do not pile up.
+func (l *rateLimiter) sweep() {
+	for range time.Tick(time.Minute) {
+		l.mutex.Lock()
+		for k, b := range l.buckets {
+			if b.Full() {
+				delete(l.buckets, k)
+			}
+		}
+		l.mutex.Unlock()
+	}
+}
+
+// writeTooManyRequests replies 429 with Retry-After in whole seconds.
+func writeTooManyRequests(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	rateLimited.Add(1)
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	http2.WriteErr(w, r, errors2.ErrTooManyRequests)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	errors2 "github.com/bcmmacro/bridging-go/library/errors"
+	http2 "github.com/bcmmacro/bridging-go/library/http"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+// hopHeaders are meaningful for a single connection only, see RFC 7230 section 6.1.
+var hopHeaders = []string{
+	"Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// copyHeaders adds the headers from gateway to dst, all values of multi-value headers are kept.
+func copyHeaders(dst http.Header, src map[string][]string) {
+	for k, v := range src {
+		k = http.CanonicalHeaderKey(k)
+		dst[k] = append(dst[k], v...)
+	}
+	for _, v := range dst["Connection"] {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" {
+				dst.Del(h)
+			}
+		}
+	}
+	for _, h := range hopHeaders {
+		dst.Del(h)
+	}
+}
+
+// validStatus tells if code can be the status of a final response.
+func validStatus(code int64) bool {
+	return code >= 200 && code <= 999
+}
+
+// bodyAllowed tells if the response can have a body, see RFC 7230 section 3.3.3.
+func bodyAllowed(r *http.Request, code int) bool {
+	return r.Method != http.MethodHead && code != http.StatusNoContent && code != http.StatusNotModified
+}
+
+// writeInfo writes a 1xx response from gateway ahead of the final response. The 1xx has only its own headers,
+// and the headers of the final response set so far are kept as they are.
+func writeInfo(w http.ResponseWriter, info *proto.Args) {
+	// 101 switches protocols, which cannot be forwarded
+	if info.StatusCode < 100 || info.StatusCode > 199 || info.StatusCode == http.StatusSwitchingProtocols {
+		return
+	}
+	h := w.Header()
+	final := h.Clone()
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range info.Headers {
+		h[http.CanonicalHeaderKey(k)] = v
+	}
+	w.WriteHeader(int(info.StatusCode))
+	for k := range h {
+		delete(h, k)
+	}
+	for k, v := range final {
+		h[k] = v
+	}
+}
+
+// writeResponse writes a complete response from gateway to client: headers, status, body then trailers.
+func writeResponse(ctx context.Context, w http.ResponseWriter, r *http.Request, resp *proto.Args) {
+	if !validStatus(resp.StatusCode) {
+		log.Ctx(ctx).Warnf("invalid status code[%d] from gateway", resp.StatusCode)
+		http2.WriteErr(w, r, errors2.ErrForward2Backend)
+		return
+	}
+	code := int(resp.StatusCode)
+
+	h := w.Header()
+	copyHeaders(h, resp.Headers)
+	if len(resp.Trailers) > 0 {
+		// trailers are declared ahead so that the response is chunked
+		for k := range resp.Trailers {
+			h.Add("Trailer", k)
+		}
+		h.Del("Content-Length")
+	} else if bodyAllowed(r, code) {
+		h.Set("Content-Length", strconv.Itoa(len(resp.Body)))
+	} else if r.Method != http.MethodHead {
+		// a HEAD response keeps the Content-Length of the GET response
+		h.Del("Content-Length")
+	}
+
+	w.WriteHeader(code)
+	if bodyAllowed(r, code) {
+		w.Write(resp.Body)
+	}
+	for k, v := range resp.Trailers {
+		h[k] = v
+	}
+}
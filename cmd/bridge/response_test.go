@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"net/textproto"
+	"testing"
+
+	"github.com/bcmmacro/bridging-go/internal/flow"
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/library/common"
+)
+
+// respond makes a request to a server which writes resp from gateway, and returns the response with its body read.
+func respond(t *testing.T, method string, resp *proto.Args) (*http.Response, string) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(r.Context(), w, r, resp)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest(method, server.URL, nil)
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, string(body)
+}
+
+func TestWriteResponse(t *testing.T) {
+	res, body := respond(t, http.MethodGet, &proto.Args{StatusCode: http.StatusCreated, Body: []byte("hello"), Headers: map[string][]string{
+		"content-length": {"999"},
+		"set-cookie":     {"a=1", "b=2"},
+		"connection":     {"x-hop"},
+		"x-hop":          {"1"},
+	}})
+	if res.StatusCode != http.StatusCreated || body != "hello" || res.ContentLength != 5 {
+		t.Errorf("got %d %q length[%d], want 201 \"hello\" length[5]", res.StatusCode, body, res.ContentLength)
+	}
+	if cookies := res.Header["Set-Cookie"]; len(cookies) != 2 {
+		t.Errorf("got Set-Cookie %v, want both values", cookies)
+	}
+	if res.Header.Get("X-Hop") != "" {
+		t.Errorf("got X-Hop, which is named by Connection")
+	}
+}
+
+func TestWriteResponseWithoutBody(t *testing.T) {
+	res, body := respond(t, http.MethodHead, &proto.Args{StatusCode: http.StatusOK, Headers: map[string][]string{"content-length": {"42"}}})
+	if res.StatusCode != http.StatusOK || body != "" || res.ContentLength != 42 {
+		t.Errorf("HEAD got %d %q length[%d], want 200 with the length of GET", res.StatusCode, body, res.ContentLength)
+	}
+
+	res, body = respond(t, http.MethodGet, &proto.Args{StatusCode: http.StatusNoContent, Body: []byte("x"), Headers: map[string][]string{"content-length": {"1"}}})
+	if res.StatusCode != http.StatusNoContent || body != "" || res.Header.Get("Content-Length") != "" {
+		t.Errorf("204 got %d %q %v, want no body nor Content-Length", res.StatusCode, body, res.Header)
+	}
+
+	res, body = respond(t, http.MethodGet, &proto.Args{StatusCode: http.StatusNotModified, Headers: map[string][]string{"etag": {`"v1"`}}})
+	if res.StatusCode != http.StatusNotModified || body != "" || res.Header.Get("Etag") != `"v1"` {
+		t.Errorf("304 got %d %q %v, want no body with Etag", res.StatusCode, body, res.Header)
+	}
+}
+
+func TestWriteResponseTrailers(t *testing.T) {
+	res, body := respond(t, http.MethodGet, &proto.Args{StatusCode: http.StatusOK, Body: []byte("hello"),
+		Headers: map[string][]string{"content-length": {"5"}}, Trailers: map[string][]string{"X-Checksum": {"abc"}}})
+	if body != "hello" || res.ContentLength != -1 || res.Trailer.Get("X-Checksum") != "abc" {
+		t.Errorf("got %q length[%d] trailers %v, want a chunked body with X-Checksum", body, res.ContentLength, res.Trailer)
+	}
+}
+
+func TestWriteResponseInvalidStatus(t *testing.T) {
+	res, _ := respond(t, http.MethodGet, &proto.Args{StatusCode: http.StatusEarlyHints})
+	if res.StatusCode != http.StatusBadGateway {
+		t.Errorf("got %d, want 502", res.StatusCode)
+	}
+}
+
+func TestForwardStreamAbortsOnException(t *testing.T) {
+	for _, exception := range []string{"", "connection reset"} {
+		q := flow.NewQueue(4, flow.PolicyDisconnect)
+		q.Push(&proto.Args{Body: []byte("part")})
+		q.Push(&proto.Args{EOF: true, Exception: exception})
+		f := &Forwarder{streams: map[string]*flow.Queue{"corr": q}}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := common.CtxWithCorrID(r.Context(), "corr")
+			f.forwardStream(ctx, w, r, &proto.Args{StatusCode: http.StatusOK, Stream: true})
+		}))
+
+		res, err := http.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		server.Close()
+		if string(body) != "part" {
+			t.Errorf("exception[%s] got body %q, want \"part\"", exception, body)
+		}
+		if exception == "" && err != nil {
+			t.Errorf("got error[%v] on a clean stream", err)
+		}
+		if exception != "" && err == nil {
+			t.Errorf("exception[%s] got a complete response, want it truncated", exception)
+		}
+	}
+}
+
+func TestWriteInfoKeepsFinalHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Final", "1")
+		writeInfo(w, &proto.Args{StatusCode: http.StatusEarlyHints, Headers: map[string][]string{"link": {"</a.css>; rel=preload"}}})
+		writeInfo(w, &proto.Args{StatusCode: http.StatusSwitchingProtocols})
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	var infos []int
+	var infoHeader textproto.MIMEHeader
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			infos = append(infos, code)
+			infoHeader = header
+			return nil
+		},
+	}
+	req, _ := http.NewRequestWithContext(httptrace.WithClientTrace(context.Background(), trace), http.MethodGet, server.URL, nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if len(infos) != 1 || infos[0] != http.StatusEarlyHints {
+		t.Fatalf("got 1xx responses %v, want [103]", infos)
+	}
+	if infoHeader.Get("Link") == "" || infoHeader.Get("X-Final") != "" {
+		t.Errorf("103 headers %v, want only Link", infoHeader)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("X-Final") != "1" || resp.Header.Get("Link") != "" {
+		t.Errorf("final response %d %v, want 200 with only X-Final", resp.StatusCode, resp.Header)
+	}
+}
+
+func TestAwaitResultDeliversQueuedInfoFirst(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		c := make(chan *proto.Args, 1)
+		infos := make(chan *proto.Args, 8)
+		for code := int64(101); code <= 103; code++ {
+			infos <- &proto.Args{StatusCode: code}
+		}
+		c <- &proto.Args{StatusCode: http.StatusOK}
+
+		var got []int64
+		resp, err := awaitResult(context.Background(), c, infos, func(info *proto.Args) {
+			got = append(got, info.StatusCode)
+		})
+		if err != nil || resp.StatusCode != http.StatusOK {
+			t.Fatalf("got %v %v, want the result", resp, err)
+		}
+		if len(got) != 3 || got[0] != 101 || got[2] != 103 {
+			t.Fatalf("got 1xx responses %v before the result, want [101 102 103]", got)
+		}
+	}
+}
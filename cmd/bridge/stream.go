@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/library/common"
+	errors2 "github.com/bcmmacro/bridging-go/library/errors"
+	http2 "github.com/bcmmacro/bridging-go/library/http"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+// cancelTimeout is how long a cancel waits for room in the send queue.
+const cancelTimeout = 3 * time.Second
+
+// forwardStream writes the response head, then flushes the body to client as it arrives from gateway.
+// The downstream request is cancelled if client goes away before the stream ends, and a stream which does not
+// end cleanly aborts the client connection, so that client sees the response is truncated.
+func (f *Forwarder) forwardStream(ctx context.Context, w http.ResponseWriter, r *http.Request, resp *proto.Args) {
+	logger := log.Ctx(ctx)
+	_, corrID := common.CorrIDCtx(ctx)
+
+	f.mutex.Lock()
+	q, ok := f.streams[corrID]
+	f.mutex.Unlock()
+	if !ok {
+		// bridge disconnected after the head arrived
+		logger.Warnf("stream not found")
+		http2.WriteErr(w, r, errors2.ErrUnavailable)
+		return
+	}
+	defer func() {
+		f.mutex.Lock()
+		delete(f.streams, corrID)
+		f.mutex.Unlock()
+	}()
+	// ctx is done once client goes away or the handler returns
+	go func() {
+		<-ctx.Done()
+		q.Close()
+	}()
+
+	if !validStatus(resp.StatusCode) {
+		logger.Warnf("invalid status code[%d] from gateway", resp.StatusCode)
+		http2.WriteErr(w, r, errors2.ErrForward2Backend)
+		f.cancel(ctx)
+		return
+	}
+	copyHeaders(w.Header(), resp.Headers)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(int(resp.StatusCode))
+	flusher, _ := w.(http.Flusher)
+	flush := func() {
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	flush()
+
+	for {
+		item, ok := q.Pop()
+		if !ok {
+			break
+		}
+		args := item.(*proto.Args)
+		if len(args.Body) > 0 {
+			if _, err := w.Write(args.Body); err != nil {
+				logger.Warnf("failed to write stream error[%v]", err)
+				break
+			}
+			flush()
+		}
+		if args.EOF {
+			for k, v := range args.Trailers {
+				w.Header()[http.TrailerPrefix+k] = v
+			}
+			if args.Exception != "" {
+				// the response is cut short, client must not take it as complete
+				logger.Warnf("stream ended error[%v]", args.Exception)
+				panic(http.ErrAbortHandler)
+			}
+			return
+		}
+	}
+	f.cancel(ctx)
+	panic(http.ErrAbortHandler)
+}
+
+// cancel tells gateway to abort the downstream request, as nobody is waiting for the response.
+// ctx is usually done by then, so the cancel waits for room in the send queue up to cancelTimeout on its own.
+func (f *Forwarder) cancel(ctx context.Context) {
+	logger := log.Ctx(ctx)
+	_, corrID := common.CorrIDCtx(ctx)
+	logger.Infof("cancel request")
+	ctx, _ = common.CorrIDCtxLogger(common.CtxWithCorrID(context.Background(), corrID))
+	ctx, cancel := context.WithTimeout(ctx, cancelTimeout)
+	defer cancel()
+	if err := f.sendWait(ctx, &proto.Packet{CorrID: corrID, Method: proto.HTTP_CANCEL, Args: &proto.Args{}}); err != nil {
+		logger.Warnf("failed to cancel request error[%v]", err)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/bcmmacro/bridging-go/internal/flow"
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/library/common"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+// tcpConn is a tunneled tcp connection, data from gateway is written by its own goroutine.
+// Data to gateway is sent within the window granted by gateway, which holds back the client through tcp.
+type tcpConn struct {
+	conn   net.Conn
+	queue  *flow.Queue
+	credit *flow.Credit // nil until gateway grants its window
+}
+
+// close ends the connection at once, the caller must hold the mutex of the forwarder.
+func (tc *tcpConn) close() {
+	tc.queue.Close()
+	if tc.credit != nil {
+		tc.credit.Close()
+	}
+	tc.conn.Close()
+}
+
+// ParseTCPListen parses mappings like ":15432->db-replica:5432,:16379->redis:6379" into listen address -> target.
+func ParseTCPListen(s string) (map[string]string, error) {
+	ret := map[string]string{}
+	for _, m := range strings.Split(s, ",") {
+		m = strings.TrimSpace(m)
+		if m == "" {
+			continue
+		}
+		parts := strings.Split(m, "->")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid tcp mapping[%s]", m)
+		}
+		ret[strings.TrimSpace(parts[0])] = strings.TrimSpace(parts[1])
+	}
+	return ret, nil
+}
+
+// ListenTCP accepts raw tcp connections on addr from the clients allowed by access, and tunnels them to target
+// through gateway.
+func (f *Forwarder) ListenTCP(addr string, target string, access *accessRules) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				log.Ctx(context.Background()).Errorf("failed to accept tcp addr[%s] error[%v]", addr, err)
+				return
+			}
+			go f.forwardTCP(conn, target, access)
+		}
+	}()
+	return nil
+}
+
+func (f *Forwarder) forwardTCP(conn net.Conn, target string, access *accessRules) {
+	defer conn.Close()
+	f.mutex.Lock()
+	connected := f.connected
+	f.mutex.Unlock()
+	if connected == nil {
+		connected = context.Background()
+	}
+	// the tunnel does not outlive the bridge it is opened on
+	ctx, logger := common.CorrIDCtxLogger(connected)
+	client := conn.RemoteAddr().String()
+	logger.Infof("recv tcp %s -> %s", client, target)
+	if err := access.checkTCP(conn); err != nil {
+		logger.Warnf("forbidden tcp error[%v]", err)
+		accessDenied.Add(1)
+		return
+	}
+
+	// registered before opening, gateway may send data right after the result
+	tcpID := uuid.New().String()
+	tc := &tcpConn{conn: conn, queue: flow.NewQueue(int(f.streamSize), flow.PolicyDisconnect)}
+	f.mutex.Lock()
+	if f.connected != connected {
+		// bridge is gone or has been replaced meanwhile
+		f.mutex.Unlock()
+		logger.Warnf("failed to open tcp error[%v]", errBridgeDisconnected)
+		return
+	}
+	f.tcps[tcpID] = tc
+	f.mutex.Unlock()
+	defer func() {
+		f.mutex.Lock()
+		delete(f.tcps, tcpID)
+		f.mutex.Unlock()
+		tc.queue.Close()
+	}()
+
+	// the window granted to gateway is the size of the queue
+	resp, err := f.req(ctx, proto.OPEN_TCP, &proto.Args{TCPID: tcpID, URL: "tcp://" + target, Client: client, Credit: f.streamSize})
+	if err != nil {
+		logger.Warnf("failed to open tcp error[%v]", err)
+		return
+	}
+	if resp.Exception != "" {
+		logger.Warnf("failed to open tcp error[%v]", resp.Exception)
+		return
+	}
+	credit := flow.NewCredit(resp.Credit)
+	f.mutex.Lock()
+	tc.credit = credit
+	f.mutex.Unlock()
+	defer credit.Close()
+	go f.writeTCP(ctx, tcpID, tc)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if !credit.Acquire() {
+				break
+			}
+			data := append([]byte(nil), buf[:n]...)
+			_, corrID := common.CorrIDCtx(ctx)
+			// within the window, so the wait is only on other traffic to gateway
+			if err := f.sendWait(ctx, &proto.Packet{CorrID: corrID, Method: proto.TCP_DATA, Args: &proto.Args{TCPID: tcpID, Body: data}}); err != nil {
+				logger.Warnf("failed to send tcp data error[%v]", err)
+				break
+			}
+		}
+		if err != nil {
+			logger.Infof("tcp closed error[%v]", err)
+			break
+		}
+	}
+	_, corrID := common.CorrIDCtx(ctx)
+	if err := f.sendWait(ctx, &proto.Packet{CorrID: corrID, Method: proto.CLOSE_TCP, Args: &proto.Args{TCPID: tcpID}}); err != nil {
+		logger.Warnf("failed to close tcp error[%v]", err)
+	}
+}
+
+// writeTCP writes the queued data from gateway to the tcp connection, and grants the consumed window back
+// to gateway. The connection is closed once the queue is closed and drained.
+func (f *Forwarder) writeTCP(ctx context.Context, tcpID string, tc *tcpConn) {
+	logger := log.Ctx(ctx)
+	defer tc.conn.Close()
+	ackEvery := f.streamSize / 2
+	if ackEvery < 1 {
+		ackEvery = 1
+	}
+	var consumed int64
+	for {
+		data, ok := tc.queue.Pop()
+		if !ok {
+			return
+		}
+		if _, err := tc.conn.Write(data.([]byte)); err != nil {
+			logger.Warnf("failed to write tcp error[%v]", err)
+			return
+		}
+		consumed++
+		if consumed >= ackEvery {
+			// a lost ack would stall the connection for good
+			_, corrID := common.CorrIDCtx(ctx)
+			if err := f.sendWait(ctx, &proto.Packet{CorrID: corrID, Method: proto.TCP_ACK, Args: &proto.Args{TCPID: tcpID, Credit: consumed}}); err != nil {
+				logger.Warnf("failed to grant tcp window, disconnecting error[%v]", err)
+				return
+			}
+			consumed = 0
+		}
+	}
+}
+
+// handleTCP handles tcp packets from gateway without blocking.
+func (f *Forwarder) handleTCP(ctx context.Context, packet *proto.Packet) {
+	logger := log.Ctx(ctx)
+	f.mutex.Lock()
+	tc, ok := f.tcps[packet.Args.TCPID]
+	var credit *flow.Credit
+	if ok {
+		credit = tc.credit
+	}
+	f.mutex.Unlock()
+	if !ok {
+		return
+	}
+
+	switch packet.Method {
+	case proto.CLOSE_TCP:
+		tc.queue.Close()
+		if credit != nil {
+			credit.Close()
+		}
+	case proto.TCP_ACK:
+		if credit != nil {
+			credit.Grant(packet.Args.Credit)
+		}
+	default:
+		if _, err := tc.queue.Push(packet.Args.Body); err == flow.ErrOverflow {
+			logger.Warnf("gateway exceeded the tcp window, disconnecting")
+			tc.conn.Close()
+		}
+	}
+}
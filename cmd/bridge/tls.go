@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// certCheckInterval is how often the certificate files are checked for changes.
+const certCheckInterval = 10 * time.Second
+
+// newTLSConfig makes the config of the tls listener from the BRIDGE_TLS_* and BRIDGE_ACME_* env, nil if bridge
+// serves cleartext. The certificate comes from files, or from an ACME CA such as Let's Encrypt, whose manager
+// is returned to answer http-01 challenges.
+// With a client CA, gateway must present a certificate issued by it on /bridge, public clients are not asked for one.
+func newTLSConfig() (*tls.Config, *autocert.Manager, error) {
+	certFile := os.Getenv("BRIDGE_TLS_CERT_FILE")
+	keyFile := os.Getenv("BRIDGE_TLS_KEY_FILE")
+	acmeDomains := os.Getenv("BRIDGE_ACME_DOMAINS")
+	clientCAFile := os.Getenv("BRIDGE_TLS_CLIENT_CA_FILE")
+
+	var cfg *tls.Config
+	var manager *autocert.Manager
+	switch {
+	case acmeDomains != "":
+		var err error
+		if manager, err = newACMEManager(acmeDomains); err != nil {
+			return nil, nil, err
+		}
+		cfg = manager.TLSConfig()
+	case certFile != "" || keyFile != "":
+		certs := &certReloader{certFile: certFile, keyFile: keyFile}
+		if err := certs.load(); err != nil {
+			return nil, nil, err
+		}
+		cfg = &tls.Config{GetCertificate: certs.GetCertificate}
+	default:
+		if clientCAFile != "" {
+			return nil, nil, fmt.Errorf("client ca requires a tls listener")
+		}
+		return nil, nil, nil
+	}
+	cfg.MinVersion = tls.VersionTLS12
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		cfg.ClientCAs = x509.NewCertPool()
+		if !cfg.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("no certificate found in client ca file[%s]", clientCAFile)
+		}
+		cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return cfg, manager, nil
+}
+
+// newACMEManager gets certificates of the domains from the ACME directory, Let's Encrypt by default.
+// BRIDGE_ACME_CA_FILE trusts a private ACME server such as Pebble.
+func newACMEManager(domains string) (*autocert.Manager, error) {
+	cacheDir := os.Getenv("BRIDGE_ACME_CACHE_DIR")
+	if cacheDir == "" {
+		cacheDir = "acme-cache"
+	}
+	client := &acme.Client{DirectoryURL: os.Getenv("BRIDGE_ACME_DIRECTORY_URL")}
+	if caFile := os.Getenv("BRIDGE_ACME_CA_FILE"); caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in acme ca file[%s]", caFile)
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+		client.HTTPClient = &http.Client{Transport: transport}
+	}
+	var hosts []string
+	for _, d := range strings.Split(domains, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			hosts = append(hosts, d)
+		}
+	}
+	return &autocert.Manager{
+		Prompt:     autocert.AcceptTOS,
+		HostPolicy: autocert.HostWhitelist(hosts...),
+		Cache:      autocert.DirCache(cacheDir),
+		Email:      os.Getenv("BRIDGE_ACME_EMAIL"),
+		Client:     client,
+	}, nil
+}
+
+// certReloader serves the certificate from files, it is reloaded once the files change.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	mutex    sync.Mutex
+	cert     *tls.Certificate
+	modTime  time.Time
+	checked  time.Time
+}
+
+func (c *certReloader) latestModTime() time.Time {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		if info, err := os.Stat(f); err == nil && info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest
+}
+
+func (c *certReloader) load() error {
+	modTime := c.latestModTime()
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = time.Now()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate, a certificate which fails to reload is kept as it is.
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if time.Since(c.checked) >= certCheckInterval {
+		c.checked = time.Now()
+		if !c.latestModTime().Equal(c.modTime) {
+			if err := c.load(); err != nil {
+				logrus.Errorf("failed to reload tls certificate error[%v]", err)
+			} else {
+				logrus.Infof("reloaded tls certificate")
+			}
+		}
+	}
+	return c.cert, nil
+}
+
+// redirectHandler redirects http requests to https on httpsPort, and answers ACME http-01 challenges.
+func redirectHandler(manager *autocert.Manager, httpsPort string) http.Handler {
+	redirect := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "" && httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+	if manager != nil {
+		return manager.HTTPHandler(redirect)
+	}
+	return redirect
+}
+
+// verifiedClient tells if the client presented a certificate issued by the client CA.
+func verifiedClient(r *http.Request) bool {
+	return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"os"
+	"testing"
+)
+
+// TestACMEIssuesCertificate gets a certificate from a Pebble server, it runs only with
+// BRIDGE_TEST_ACME_DIRECTORY_URL and BRIDGE_TEST_ACME_CA_FILE set, see README.
+func TestACMEIssuesCertificate(t *testing.T) {
+	directoryURL := os.Getenv("BRIDGE_TEST_ACME_DIRECTORY_URL")
+	if directoryURL == "" {
+		t.Skip("no ACME server, set BRIDGE_TEST_ACME_DIRECTORY_URL and BRIDGE_TEST_ACME_CA_FILE")
+	}
+	domain := envOr("BRIDGE_TEST_ACME_DOMAIN", "bridge.test")
+	t.Setenv("BRIDGE_ACME_DIRECTORY_URL", directoryURL)
+	t.Setenv("BRIDGE_ACME_CA_FILE", os.Getenv("BRIDGE_TEST_ACME_CA_FILE"))
+	t.Setenv("BRIDGE_ACME_CACHE_DIR", t.TempDir())
+	manager, err := newACMEManager(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the challenges are answered on the ports Pebble validates on, its httpPort and tlsPort
+	httpListener, err := net.Listen("tcp", envOr("BRIDGE_TEST_ACME_HTTP_ADDR", ":5002"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer := &http.Server{Handler: manager.HTTPHandler(nil)}
+	go httpServer.Serve(httpListener)
+	defer httpServer.Close()
+	tlsListener, err := tls.Listen("tcp", envOr("BRIDGE_TEST_ACME_TLS_ADDR", ":5001"), manager.TLSConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsServer := &http.Server{Handler: http.NotFoundHandler()}
+	go tlsServer.Serve(tlsListener)
+	defer tlsServer.Close()
+
+	cert, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cert.Leaf.VerifyHostname(domain); err != nil {
+		t.Errorf("got certificate for %v, want %s", cert.Leaf.DNSNames, domain)
+	}
+}
+
+func envOr(key string, def string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return def
+}
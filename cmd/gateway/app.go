@@ -4,38 +4,100 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"errors"
+	"expvar"
+	"io"
 	"io/ioutil"
+	"mime"
 	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
 	"net/url"
 	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http2"
 
+	"github.com/bcmmacro/bridging-go/internal/auth"
 	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/internal/flow"
 	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/internal/seal"
+	errs "github.com/bcmmacro/bridging-go/library/errors"
 	"github.com/bcmmacro/bridging-go/library/log"
 )
 
+var (
+	shadowChecks     = expvar.NewInt("gateway_shadow_checks")
+	shadowWouldAllow = expvar.NewInt("gateway_shadow_would_allow") // denied by the whitelist, allowed by the shadow
+	shadowWouldDeny  = expvar.NewInt("gateway_shadow_would_deny")  // allowed by the whitelist, denied by the shadow
+)
+
 type Gateway struct {
 	bridge       *websocket.Conn
-	ws           map[string]*websocket.Conn
+	ws           map[string]*wsSession
+	cancels      map[string]context.CancelFunc // in-flight http requests
+	tcps         map[string]*tcpSession
+	bodies       map[string]*reqBody // request bodies streamed from bridge
+	h2c          *http2.Transport
+	limits       *limiters
+	breakers     *breakers
+	retryBudget  *flow.Budget
+	client       *http.Client // shared by all http calls to downstream services
+	tls          *tlsConfigs
+	sealKeys     *seal.Keys    // keys the packets on /bridge are sealed with, nil if they are not
+	audit        *auditor      // nil if the traffic is not audited
+	session      *seal.Session // sealed session of the current bridge connection
 	whitelistMap *config.WhitelistMap
+	conf         *config.Config
 	mutex        sync.Mutex
 	wsChan       chan wsChanItem
 }
 
+// wsSession is a downstream websocket connection, its messages are queued and sent to bridge
+// within the window granted by bridge.
+type wsSession struct {
+	conn   *websocket.Conn
+	queue  *flow.Queue
+	credit *flow.Credit
+}
+
+func (s *wsSession) close() {
+	s.conn.Close()
+	s.credit.Close()
+	s.queue.Close()
+}
+
 type wsChanItem struct {
 	packet *proto.Packet
 	ctx    context.Context
 }
 
-func NewGateway(whitelistMap *config.WhitelistMap) *Gateway {
+func NewGateway(conf *config.Config) *Gateway {
+	tlsConfigs, err := newTLSConfigs(conf.NetlocTLS)
+	errs.Check(err)
+	sealKeys, err := seal.ParseKeys(conf.SealKeys)
+	errs.Check(err)
+	auditor, err := newAuditor(conf.Audit)
+	errs.Check(err)
 	return &Gateway{
 		bridge:       nil,
-		ws:           map[string]*websocket.Conn{},
-		whitelistMap: whitelistMap,
+		ws:           map[string]*wsSession{},
+		cancels:      map[string]context.CancelFunc{},
+		tcps:         map[string]*tcpSession{},
+		bodies:       map[string]*reqBody{},
+		h2c:          newH2CTransport(conf.Transport, tlsConfigs),
+		limits:       newLimiters(conf),
+		breakers:     newBreakers(conf),
+		retryBudget:  flow.NewBudget(conf.RetryBudget, retryReserve),
+		client:       &http.Client{Transport: newTransport(conf.Transport, tlsConfigs)},
+		tls:          tlsConfigs,
+		sealKeys:     sealKeys,
+		audit:        auditor,
+		whitelistMap: &conf.WhitelistMap,
+		conf:         conf,
 		wsChan:       make(chan wsChanItem, 64), // channel to publish msg from gateway to bridge
 	}
 }
@@ -66,23 +128,75 @@ func (gw *Gateway) flush() {
 // connect makes a persistant connection to bridge's websocket, to allow data to flow between private DC and outbound server.
 func (gw *Gateway) connect(bridgeNetloc string, bridgeToken string, retry int) {
 	bridgeURL := bridgeNetloc + "/bridge"
-	wss, _, err := websocket.DefaultDialer.Dial(bridgeURL, http.Header{"bridging-token": []string{bridgeToken}})
+	dialer := *websocket.DefaultDialer
+	if gw.conf.BridgeTLS != nil {
+		// loaded on every connect, so that renewed certificates are picked up
+		c := &tlsConfig{conf: *gw.conf.BridgeTLS}
+		if err := c.load(); err != nil {
+			logrus.Errorf("Failed to load bridge tls error[%v]. Retrying in %v seconds", err, retry)
+			return
+		}
+		dialer.TLSClientConfig = c.tls
+	}
+	header := http.Header{}
+	if gw.conf.BridgeKey == "" {
+		// with a key, gateway answers the challenge of bridge instead, the token is never sent
+		header.Set("bridging-token", bridgeToken)
+	}
+	wss, _, err := dialer.Dial(bridgeURL, header)
 	if err != nil {
 		// Connection to bridge fail
 		logrus.Errorf("Dial: %v. Retrying in %v seconds", err, retry)
 		return
 	}
+	if gw.conf.BridgeKey != "" {
+		if err := answerChallenge(wss, gw.conf.BridgeKeyID, []byte(gw.conf.BridgeKey)); err != nil {
+			logrus.Errorf("Failed to answer challenge of bridge error[%v]. Retrying in %v seconds", err, retry)
+			wss.Close()
+			return
+		}
+	}
+	var session *seal.Session
+	if gw.sealKeys != nil {
+		if session, err = startSession(wss, gw.sealKeys); err != nil {
+			logrus.Errorf("Failed to start sealed session error[%v]. Retrying in %v seconds", err, retry)
+			wss.Close()
+			return
+		}
+	}
+	gw.audit.connected(bridgeURL)
+	if err := gw.audit.failing(); err != nil {
+		logrus.Errorf("Failed to write audit log error[%v]. Retrying in %v seconds", err, retry)
+		wss.Close()
+		return
+	}
 	defer func() {
 		// Handle bridge disconnect
 		logrus.Warnf("Disconnected bridge websocket [%v]", bridgeURL)
+		gw.mutex.Lock()
+		gw.session = nil
+		gw.bridge = nil
 		for _, v := range gw.ws {
-			v.Close()
+			v.close()
+		}
+		for _, v := range gw.tcps {
+			v.close()
 		}
+		// nobody is left to take the results, the downstream requests are aborted
+		for _, cancel := range gw.cancels {
+			cancel()
+		}
+		gw.mutex.Unlock()
 		wss.Close()
+		gw.audit.disconnected()
 	}()
 
 	logrus.Info("Connected to bridge")
+	// read by flush, which sends on whichever connection is current
+	gw.mutex.Lock()
+	gw.session = session
 	gw.bridge = wss
+	gw.mutex.Unlock()
 	ctx := context.Background()
 
 	for {
@@ -95,6 +209,14 @@ func (gw *Gateway) connect(bridgeNetloc string, bridgeToken string, retry int) {
 		if msgType != websocket.BinaryMessage && msgType != websocket.TextMessage {
 			continue
 		}
+		if session != nil {
+			if wsMsg, err = session.Open(wsMsg); err != nil {
+				// the packets after it cannot be trusted either
+				sealRejected.Add(1)
+				logrus.Warnf("Rejected packet from bridge, disconnecting error[%v]", err)
+				break
+			}
+		}
 		msg, err := proto.Deserialize(ctx, wsMsg)
 		if err != nil {
 			continue
@@ -102,6 +224,11 @@ func (gw *Gateway) connect(bridgeNetloc string, bridgeToken string, retry int) {
 		ctx, logger := log.WithField(ctx, "ReqID", msg.CorrID)
 
 		logger.Infof("Recv bridge msg: %s", msg)
+		gw.audit.in(msg)
+		if err := gw.audit.failing(); err != nil {
+			logger.Errorf("Failed to write audit log, disconnecting bridge error[%v]", err)
+			break
+		}
 
 		method := proto.PacketMethod(msg.Method)
 		corrID := msg.CorrID
@@ -110,27 +237,51 @@ func (gw *Gateway) connect(bridgeNetloc string, bridgeToken string, retry int) {
 		switch method {
 		case proto.HTTP:
 			go gw.handleHttp(ctx, corrID, args)
+		case proto.GRPC:
+			body := gw.openBody(corrID)
+			go gw.handleGRPC(ctx, corrID, args, body)
+		case proto.HTTP_BODY:
+			gw.handleBody(ctx, corrID, args)
+		case proto.HTTP_CANCEL:
+			gw.mutex.Lock()
+			cancel, present := gw.cancels[corrID]
+			gw.mutex.Unlock()
+			if present {
+				cancel()
+			}
 		case proto.OPEN_WEBSOCKET:
 			go gw.handleOpenWebsocket(ctx, corrID, args)
 		case proto.WEBSOCKET_MSG:
 			gw.mutex.Lock()
-			conn, present := gw.ws[args.WSID]
+			session, present := gw.ws[args.WSID]
+			gw.mutex.Unlock()
+			if present {
+				send(ctx, session.conn, args.Msg)
+			}
+		case proto.WEBSOCKET_ACK:
+			gw.mutex.Lock()
+			session, present := gw.ws[args.WSID]
 			gw.mutex.Unlock()
 			if present {
-				send(ctx, conn, args.Msg)
+				session.credit.Grant(args.Credit)
 			}
 		case proto.CLOSE_WEBSOCKET:
 			gw.mutex.Lock()
-			conn, present := gw.ws[args.WSID]
+			session, present := gw.ws[args.WSID]
 			if present {
-				err := conn.Close()
-				if err != nil {
-					logger.Warnf("Failed to close downstream websockets connection. Err[%v]", err)
-				}
+				session.close()
 				delete(gw.ws, args.WSID)
 			}
 			gw.mutex.Unlock()
 			gw.wsChan <- wsChanItem{packet: createProtoPackage(corrID, proto.CLOSE_WEBSOCKET_RESULT, &proto.Args{WSID: args.WSID}), ctx: ctx}
+		case proto.OPEN_TCP:
+			go gw.handleOpenTCP(ctx, corrID, args)
+		case proto.TCP_DATA:
+			gw.handleTCPData(ctx, args)
+		case proto.TCP_ACK:
+			gw.handleTCPAck(args)
+		case proto.CLOSE_TCP:
+			gw.handleCloseTCP(args)
 		default:
 			logger.Warnf("Unsupported method passed down by bridge method[%v]", msg.Method)
 		}
@@ -142,9 +293,36 @@ func (gw *Gateway) sendBridge(ctx context.Context, p *proto.Packet, compressor *
 	if err != nil {
 		return
 	}
-	err = gw.bridge.WriteMessage(websocket.BinaryMessage, msg)
+	gw.mutex.Lock()
+	bridge, session := gw.bridge, gw.session
+	gw.mutex.Unlock()
+	if bridge == nil {
+		log.Ctx(ctx).Warnf("Dropped packet as bridge is disconnected [%s]", p)
+		return
+	}
+	// failing closed, nothing is sent before it is recorded
+	recordFirst := gw.audit.failClosing()
+	if recordFirst {
+		gw.audit.out(p)
+		if err := gw.audit.failing(); err != nil {
+			log.Ctx(ctx).Errorf("Failed to write audit log, dropped packet and disconnecting bridge error[%v]", err)
+			bridge.Close()
+			return
+		}
+	}
+	if session != nil {
+		if msg, err = session.Seal(msg); err != nil {
+			log.Ctx(ctx).Warnf("Failed to seal packet error[%v]", err)
+			return
+		}
+	}
+	err = bridge.WriteMessage(websocket.BinaryMessage, msg)
 	if err != nil {
 		log.Ctx(ctx).Warnf("Failed to transmit packet to bridge")
+		return
+	}
+	if !recordFirst {
+		gw.audit.out(p)
 	}
 }
 
@@ -172,12 +350,26 @@ func (gw *Gateway) handleOpenWebsocket(ctx context.Context, corrID string, args
 	}
 
 	// Check if downstream route is present in firewall
-	err = gw.firewall(ctx, "websocket", url)
+	rule, err := gw.firewall(ctx, corrID, "websocket", url, args.Headers)
 	if err != nil {
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.OPEN_WEBSOCKET_RESULT, &proto.Args{WSID: wsid, Exception: err.Error()})}
 		return
 	}
 
-	ws, _, err := websocket.DefaultDialer.Dial(url.String(), nil)
+	gw.audit.matched(wsid, rule)
+	// services in netloc_tls are reached over tls, the whitelist is checked on the url as received
+	gw.tls.upgrade(url)
+
+	header := http.Header{}
+	setForwarded(header, args)
+	for _, k := range []string{auth.IdentityHeader, auth.IdentitySignatureHeader} {
+		if v := http.Header(args.Headers).Get(k); v != "" {
+			header.Set(k, v)
+		}
+	}
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = gw.tls.get(url.Host)
+	ws, _, err := dialer.Dial(url.String(), header)
 	if err != nil {
 		logger.Warnf("Failed to open websockets connection with destination[%v]", url.String())
 		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.OPEN_WEBSOCKET_RESULT, &proto.Args{WSID: wsid, Exception: err.Error()})}
@@ -185,15 +377,20 @@ func (gw *Gateway) handleOpenWebsocket(ctx context.Context, corrID string, args
 	}
 	logger.Infof("Connected ws url[%v]\n", url.String())
 
-	// Store downstream websocket connections in Gateway
+	// Store downstream websocket connections in Gateway, the initial window is granted by bridge.
+	session := &wsSession{
+		conn:   ws,
+		queue:  flow.NewQueue(gw.conf.WebsocketQueueSize, gw.conf.WebsocketOverflowPolicy),
+		credit: flow.NewCredit(args.Credit),
+	}
 	gw.mutex.Lock()
-	gw.ws[wsid] = ws
+	gw.ws[wsid] = session
 	gw.mutex.Unlock()
 
 	defer func() {
 		// Handle when downstream websocket disconnects
 		logger.Infof("Disconnected downstream websocket [%v]", url.String())
-		ws.Close()
+		session.close()
 		gw.mutex.Lock()
 		delete(gw.ws, wsid)
 		gw.mutex.Unlock()
@@ -201,51 +398,164 @@ func (gw *Gateway) handleOpenWebsocket(ctx context.Context, corrID string, args
 
 	gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.OPEN_WEBSOCKET_RESULT, &proto.Args{WSID: wsid})}
 
+	done := make(chan struct{})
+	go gw.pump(session, done)
+
 	for {
 		_, wsMsg, err := ws.ReadMessage()
 		if err != nil {
-			// Inform bridge that downstream websockets is disconnected
 			logger.Warnf("Invalid message received [%v] Closing websockets connection ID [%v]", err, wsid)
-			gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.CLOSE_WEBSOCKET, &proto.Args{WSID: wsid})}
 			break
 		}
 		// Forward downstream websockets message to bridge
-		logger.Debug("Recv msg[%s]", string(wsMsg))
-		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.WEBSOCKET_MSG, &proto.Args{WSID: wsid, Msg: string(wsMsg)})}
+		logger.Debugf("Recv msg[%s]", string(wsMsg))
+		item := wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.WEBSOCKET_MSG, &proto.Args{WSID: wsid, Msg: string(wsMsg)})}
+		dropped, err := session.queue.Push(item)
+		if dropped > 0 {
+			logger.Warnf("Send window exceeded, dropped [%d] messages of websockets connection ID [%v]", dropped, wsid)
+		}
+		if err != nil {
+			logger.Warnf("Send window exceeded [%v] Closing websockets connection ID [%v]", err, wsid)
+			session.credit.Close()
+			break
+		}
 	}
+
+	// Inform bridge that downstream websockets is disconnected, after the queued messages are sent
+	session.queue.Close()
+	<-done
+	gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.CLOSE_WEBSOCKET, &proto.Args{WSID: wsid})}
 }
 
-func (gw *Gateway) firewall(ctx context.Context, method string, url *url.URL) error {
-	return gw.whitelistMap.Check(ctx, method, url)
+// pump sends the queued messages of a downstream websocket to bridge, within the window granted by bridge.
+func (gw *Gateway) pump(session *wsSession, done chan struct{}) {
+	defer close(done)
+	for {
+		item, ok := session.queue.Pop()
+		if !ok || !session.credit.Acquire() {
+			return
+		}
+		gw.wsChan <- item.(wsChanItem)
+	}
+}
+
+// firewall checks the route and the identity of the client against the whitelist, so that downstream services
+// only get identities signed by bridge. The shadow whitelist, if any, is checked as well, and where it disagrees
+// this is logged and counted, but the whitelist decides.
+func (gw *Gateway) firewall(ctx context.Context, corrID string, method string, url *url.URL, header http.Header) (*config.WhitelistConfig, error) {
+	rule, err := gw.whitelistMap.Check(ctx, corrID, method, url, header)
+	if shadow := gw.conf.ShadowWhitelistMap; shadow != nil {
+		shadowChecks.Add(1)
+		shadowRule, shadowErr := shadow.Match(corrID, method, url, header)
+		if err == nil && shadowErr != nil {
+			shadowWouldDeny.Add(1)
+			log.Ctx(ctx).Warnf("Shadow whitelist would deny [%s %s] allowed by rule[%v] error[%v]", method, url, rule, shadowErr)
+		} else if err != nil && shadowErr == nil {
+			shadowWouldAllow.Add(1)
+			log.Ctx(ctx).Warnf("Shadow whitelist would allow [%s %s] by rule[%v] denied error[%v]", method, url, shadowRule, err)
+		}
+	}
+	return rule, err
+}
+
+// cancellable returns a context which can be cancelled by bridge once the client goes away,
+// done must be called when the request finishes.
+func (gw *Gateway) cancellable(ctx context.Context, corrID string) (context.Context, func()) {
+	ctx, cancel := context.WithCancel(ctx)
+	gw.mutex.Lock()
+	gw.cancels[corrID] = cancel
+	gw.mutex.Unlock()
+	return ctx, func() {
+		gw.mutex.Lock()
+		delete(gw.cancels, corrID)
+		gw.mutex.Unlock()
+		cancel()
+	}
 }
 
 // handleHttp handles incoming http requests by forwarding them to the appropriate services.
 func (gw *Gateway) handleHttp(ctx context.Context, corrID string, args *proto.Args) {
 	logger := log.Ctx(ctx)
+	ctx, done := gw.cancellable(ctx, corrID)
+	defer done()
+
 	req, err := deserializeRequest(ctx, args)
 	if err != nil {
 		logger.Warn("Failed to deserialize incoming http request")
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(400))}
 		return
 	}
 
 	// Check if downstream route is present in firewall
-	err = gw.firewall(ctx, req.Method, req.URL)
+	rule, err := gw.firewall(ctx, corrID, req.Method, req.URL, req.Header)
 	if err != nil {
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(403))}
+		return
+	}
+	gw.audit.matched(corrID, rule)
+	// services in netloc_tls are reached over tls, the whitelist is checked on the url as received
+	gw.tls.upgrade(req.URL)
+
+	release, err := gw.limits.acquire(ctx, req.URL.Host, rule)
+	if err != nil {
+		logger.Warnf("Rejected by concurrency limit [%v]", err)
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(503))}
+		return
+	}
+	defer release()
+
+	report, err := gw.breakers.allow(req.URL.Host, rule)
+	if err != nil {
+		logger.Warnf("Rejected by circuit breaker of [%s]", req.URL.Host)
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(503))}
 		return
 	}
 
 	logger.Debugf("Build http Req [%+v]", req)
 
-	client := http.Client{}
-	resp, err := client.Do(req)
+	// 1xx responses such as 103 Early Hints are forwarded ahead of the final response,
+	// 100 Continue is not as bridge has read the whole request body already.
+	trace := &httptrace.ClientTrace{
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			if code == http.StatusContinue {
+				return nil
+			}
+			headers := make(map[string][]string)
+			for k, v := range header {
+				headers[k] = append([]string(nil), v...)
+			}
+			gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_INFO, &proto.Args{StatusCode: int64(code), Headers: headers})}
+			return nil
+		},
+	}
+	timeout := startTimeout(ctx, gw.conf.TimeoutOf(rule))
+	defer timeout.stop()
+	req = req.WithContext(httptrace.WithClientTrace(timeout.ctx, trace))
+
+	resp, err := gw.do(timeout.ctx, gw.client, req, rule)
+	report(outcome(ctx, resp, err))
 	var p *proto.Packet
 	if err != nil {
 		logger.Warnf("Failed to get a response from http req[%v]", err)
-		args := proto.MakeHTTPErrprRespArgs(500)
-		p = createProtoPackage(corrID, proto.HTTP_RESULT, args)
+		if timeout.expired(err) {
+			p = createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(504))
+		} else {
+			p = createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(500))
+		}
 	} else {
+		defer resp.Body.Close()
 		logger.Debugf("Recv http resp[%v]", resp)
-		p = sanitizeResponse(ctx, resp, corrID)
+		if isStream(rule, resp) {
+			timeout.disarm()
+			gw.stream(ctx, corrID, resp)
+			return
+		}
+		p = gw.sanitizeResponse(ctx, resp, corrID, gw.conf.MaxResponseSizeOf(rule))
+		// the timeout covers reading the body as well
+		if timeout.expired(nil) {
+			logger.Warnf("Timed out reading http resp")
+			p = createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(504))
+		}
 	}
 
 	logger.Infof("send bridge [%s]", p)
@@ -255,17 +565,83 @@ func (gw *Gateway) handleHttp(ctx context.Context, corrID string, args *proto.Ar
 	}
 }
 
-// sanitizeResponse removes unnecessary data from headers and parses response into a Packet.
-func sanitizeResponse(ctx context.Context, resp *http.Response, corrID string) *proto.Packet {
+// outcome tells how a call to a downstream service went, for the circuit breaker.
+// Calls cancelled by bridge tell nothing about the service.
+func outcome(ctx context.Context, resp *http.Response, err error) flow.Outcome {
+	if err != nil && ctx.Err() != nil {
+		return flow.Ignored
+	} else if err != nil || resp.StatusCode >= 500 {
+		return flow.Failed
+	}
+	return flow.Succeeded
+}
+
+// isStream tells if the response never finishes or should be forwarded as it arrives.
+func isStream(rule *config.WhitelistConfig, resp *http.Response) bool {
+	if rule.Stream {
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
+
+// stream forwards the response body to bridge chunk by chunk as it arrives, until EOF or cancelled by bridge.
+// It returns the error the body ended with, nil on EOF.
+func (gw *Gateway) stream(ctx context.Context, corrID string, resp *http.Response) error {
 	logger := log.Ctx(ctx)
-	for _, header := range []string{"Content-Encoding", "Content-Length"} {
-		if resp.Header.Get(header) != "" {
-			resp.Header.Del(header)
+	sanitizeHeaders(resp)
+	gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPStreamRespArgs(resp))}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := resp.Body.Read(buf)
+		if n > 0 {
+			body := append([]byte(nil), buf[:n]...)
+			gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_BODY, &proto.Args{Body: body})}
+		}
+		if err == io.EOF {
+			// trailers are only known once the body is read
+			trailers := map[string][]string(resp.Trailer)
+			gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_BODY, &proto.Args{EOF: true, Trailers: trailers})}
+			return nil
+		}
+		if err != nil {
+			logger.Warnf("Failed to read http stream [%v]", err)
+			gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_BODY, &proto.Args{EOF: true, Exception: err.Error()})}
+			return err
 		}
 	}
+}
 
+// sanitizeHeaders removes Content-Length as bridge sets it from the body it writes, except for HEAD.
+// Content-Encoding is kept, it is already removed if the body was decompressed by the transport.
+func sanitizeHeaders(resp *http.Response) {
+	if resp.Request != nil && resp.Request.Method == http.MethodHead {
+		return
+	}
+	resp.Header.Del("Content-Length")
+}
+
+// sanitizeResponse removes unnecessary data from headers and parses response into a Packet.
+// A response body over limit bytes is replaced by a 502, as it would be held in memory by both gateway and bridge,
+// which is recorded in the audit log as the body does not leave.
+func (gw *Gateway) sanitizeResponse(ctx context.Context, resp *http.Response, corrID string, limit int64) *proto.Packet {
+	logger := log.Ctx(ctx)
+	sanitizeHeaders(resp)
+
+	// a HEAD response declares the length of a body it does not have
+	if limit > 0 && resp.ContentLength > limit && resp.Body != http.NoBody {
+		logger.Warnf("Response size[%d] is over limit[%d]", resp.ContentLength, limit)
+		gw.audit.dlp(corrID, dlpResponseTooLarge)
+		return createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(502))
+	}
+	resp.Body = flow.LimitBody(resp.Body, limit)
 	args, err := proto.MakeHTTPRespArgs(ctx, resp)
-	if err != nil {
+	if errors.Is(err, flow.ErrTooLarge) {
+		logger.Warnf("Response size is over limit[%d]", limit)
+		gw.audit.dlp(corrID, dlpResponseTooLarge)
+		args = proto.MakeHTTPErrprRespArgs(502)
+	} else if err != nil {
 		logger.Warnf("Failed to create http resp args [%v]", err)
 		args = proto.MakeHTTPErrprRespArgs(400)
 	}
@@ -290,7 +666,7 @@ func deserializeRequest(ctx context.Context, args *proto.Args) (*http.Request, e
 		return nil, err
 	}
 
-	req, err := http.NewRequest(args.Method, url, bytes.NewReader(args.Body))
+	req, err := http.NewRequestWithContext(ctx, args.Method, url, bytes.NewReader(args.Body))
 	if err != nil {
 		logger.Warn("Failed to parse args into a http request obj")
 		return req, err
@@ -301,5 +677,6 @@ func deserializeRequest(ctx context.Context, args *proto.Args) (*http.Request, e
 			req.Header.Add(k, vv)
 		}
 	}
+	setForwarded(req.Header, args)
 	return req, nil
 }
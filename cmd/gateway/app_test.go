@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/audit"
+	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/internal/flow"
+	"github.com/bcmmacro/bridging-go/internal/proto"
+)
+
+// earlyHintsServer is a downstream service which sends 103 Early Hints before its response, after it drops the
+// first failures connections without any response.
+func earlyHintsServer(t *testing.T, failures int32) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				if atomic.AddInt32(&failures, -1) >= 0 {
+					return
+				}
+				fmt.Fprint(conn, "HTTP/1.1 103 Early Hints\r\nLink: </a.css>; rel=preload\r\n\r\n")
+				fmt.Fprint(conn, "HTTP/1.1 200 OK\r\nX-Final: 1\r\nContent-Length: 2\r\nConnection: close\r\n\r\nok")
+			}()
+		}
+	}()
+	return l
+}
+
+func TestHandleHttpForwardsInfoBeforeResult(t *testing.T) {
+	l := earlyHintsServer(t, 0)
+	defer l.Close()
+	expectInfoBeforeResult(t, l.Addr().String(), "")
+}
+
+func TestHandleHttpForwardsInfoOfRetry(t *testing.T) {
+	l := earlyHintsServer(t, 1)
+	defer l.Close()
+	expectInfoBeforeResult(t, l.Addr().String(), `"retry": {"attempts": 1, "backoff_ms": 1},`)
+}
+
+func expectInfoBeforeResult(t *testing.T, netloc string, conf string) {
+	gw := NewGateway(config.Deserialize([]byte(fmt.Sprintf(
+		`{%s "whitelist": [{"netloc": [%q], "method": ["GET"], "scheme": ["http"], "path": ["/hints"]}]}`, conf, netloc))))
+
+	go gw.handleHttp(context.Background(), "corr", &proto.Args{Method: http.MethodGet, URL: "http://" + netloc + "/hints"})
+
+	var methods []proto.PacketMethod
+	for {
+		select {
+		case item := <-gw.wsChan:
+			p := item.packet
+			methods = append(methods, p.Method)
+			switch p.Method {
+			case proto.HTTP_INFO:
+				if p.Args.StatusCode != http.StatusEarlyHints || http.Header(p.Args.Headers).Get("Link") == "" {
+					t.Errorf("got info %v, want 103 with Link", p.Args)
+				}
+			case proto.HTTP_RESULT:
+				if p.Args.StatusCode != http.StatusOK || string(p.Args.Body) != "ok" {
+					t.Errorf("got result %v, want 200 ok", p.Args)
+				}
+				if len(methods) != 2 || methods[0] != proto.HTTP_INFO {
+					t.Errorf("got packets %v, want the info before the result", methods)
+				}
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no result, got packets %v", methods)
+		}
+	}
+}
+
+func TestHandleHttpForwardsTrailers(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Write([]byte("ok"))
+		w.Header().Set("X-Checksum", "abc")
+		// undeclared, only known once the body is written
+		w.Header().Set(http.TrailerPrefix+"X-Late", "1")
+	}))
+	defer srv.Close()
+	netloc := strings.TrimPrefix(srv.URL, "http://")
+	gw := NewGateway(config.Deserialize([]byte(fmt.Sprintf(
+		`{"whitelist": [{"netloc": [%q], "method": ["GET"], "scheme": ["http"], "path": ["/trailers"]}]}`, netloc))))
+
+	go gw.handleHttp(context.Background(), "corr", &proto.Args{Method: http.MethodGet, URL: srv.URL + "/trailers"})
+
+	for {
+		select {
+		case item := <-gw.wsChan:
+			p := item.packet
+			if p.Method != proto.HTTP_RESULT {
+				continue
+			}
+			if p.Args.StatusCode != http.StatusOK || string(p.Args.Body) != "ok" {
+				t.Errorf("got result %v, want 200 ok", p.Args)
+			}
+			trailers := http.Header(p.Args.Trailers)
+			if trailers.Get("X-Checksum") != "abc" || trailers.Get("X-Late") != "1" {
+				t.Errorf("got trailers %v, want X-Checksum and X-Late", p.Args.Trailers)
+			}
+			return
+		case <-time.After(5 * time.Second):
+			t.Fatal("no result")
+		}
+	}
+}
+
+func TestGrpcOutcome(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, c := range []struct {
+		ctx     context.Context
+		header  string
+		trailer string
+		err     error
+		want    flow.Outcome
+	}{
+		{context.Background(), "", "0", nil, flow.Succeeded},
+		{context.Background(), "", "5", nil, flow.Succeeded},
+		{context.Background(), "", "14", nil, flow.Failed},
+		{context.Background(), "", "4", nil, flow.Failed},
+		{context.Background(), "14", "", nil, flow.Failed},
+		{context.Background(), "", "", nil, flow.Failed},
+		{context.Background(), "", "", io.ErrUnexpectedEOF, flow.Failed},
+		{cancelled, "", "", context.Canceled, flow.Ignored},
+	} {
+		resp := &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Trailer: http.Header{}}
+		if c.header != "" {
+			resp.Header.Set("Grpc-Status", c.header)
+		}
+		if c.trailer != "" {
+			resp.Trailer.Set("Grpc-Status", c.trailer)
+		}
+		if got := grpcOutcome(c.ctx, resp, c.err); got != c.want {
+			t.Errorf("got %v for status[%s/%s] error[%v], want %v", got, c.header, c.trailer, c.err, c.want)
+		}
+	}
+}
+
+func TestAuditRecordsOversizedResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 100)))
+	}))
+	defer srv.Close()
+	dir := t.TempDir()
+	netloc := strings.TrimPrefix(srv.URL, "http://")
+	gw := NewGateway(config.Deserialize([]byte(fmt.Sprintf(
+		`{"audit": {"dir": %q}, "whitelist": [{"netloc": [%q], "method": ["GET"], "scheme": ["http"], "path": ["/big"], "max_response_size": 10}]}`, dir, netloc))))
+
+	args := &proto.Args{Method: http.MethodGet, URL: srv.URL + "/big"}
+	gw.audit.in(&proto.Packet{CorrID: "corr", Method: proto.HTTP, Args: args})
+	go gw.handleHttp(context.Background(), "corr", args)
+	select {
+	case item := <-gw.wsChan:
+		if item.packet.Args.StatusCode != http.StatusBadGateway {
+			t.Errorf("got result %v, want 502", item.packet.Args)
+		}
+		gw.audit.out(item.packet)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no result")
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "audit.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r audit.Record
+	if err := json.Unmarshal(data, &r); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.DLP) != 1 || r.DLP[0] != dlpResponseTooLarge || r.Status != http.StatusBadGateway {
+		t.Errorf("got record %+v, want 502 with dlp[%s]", r, dlpResponseTooLarge)
+	}
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"hash"
+	"net/http"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/bcmmacro/bridging-go/internal/audit"
+	"github.com/bcmmacro/bridging-go/internal/auth"
+	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/internal/proto"
+)
+
+var auditFailed = expvar.NewInt("gateway_audit_failed")
+
+// dlpResponseTooLarge is the data loss prevention action of a response body over max_response_size replaced by a 502.
+const dlpResponseTooLarge = "response_too_large"
+
+// auditor records the traffic through gateway from the packets exchanged with bridge, so that the records hold
+// exactly what left the private DC. An http or gRPC call is recorded once its response is sent, a websocket
+// on open, on each message and on close, a tcp connection on close, and what is pending when bridge disconnects.
+// Failing closed, the packets to bridge are recorded right before they are sent instead.
+type auditor struct {
+	log        *audit.Log
+	failClosed bool // traffic stops while records cannot be written
+	mutex      sync.Mutex
+	err        error                  // of the last record written
+	calls      map[string]*auditEntry // http and gRPC calls by corrID
+	conns      map[string]*auditEntry // websocket and tcp connections by their id
+}
+
+type auditEntry struct {
+	record   audit.Record
+	request  hash.Hash // of the bytes from bridge
+	response hash.Hash // of the bytes to bridge
+}
+
+func newAuditor(conf *config.Audit) (*auditor, error) {
+	if conf == nil {
+		return nil, nil
+	}
+	l, err := audit.Open(conf.Dir, int64(conf.MaxSizeMB)<<20, conf.MaxFiles, []byte(conf.Key))
+	if err != nil {
+		return nil, err
+	}
+	return &auditor{log: l, failClosed: conf.FailClosed, calls: map[string]*auditEntry{}, conns: map[string]*auditEntry{}}, nil
+}
+
+func newAuditEntry(kind string, corrID string, args *proto.Args) *auditEntry {
+	e := &auditEntry{
+		record:   audit.Record{Kind: kind, CorrID: corrID, Client: args.Client, Method: args.Method},
+		request:  sha256.New(),
+		response: sha256.New(),
+	}
+	if id, err := auth.ParseIdentity(http.Header(args.Headers)); err == nil {
+		e.record.Identity = id
+	}
+	return e
+}
+
+func (e *auditEntry) in(data []byte) {
+	e.record.RequestBytes += int64(len(data))
+	e.request.Write(data)
+}
+
+func (e *auditEntry) out(data []byte) {
+	e.record.ResponseBytes += int64(len(data))
+	e.response.Write(data)
+}
+
+// write records the entry, the hashes are left out for the directions without any bytes.
+func (a *auditor) write(e *auditEntry) {
+	r := e.record
+	if r.RequestBytes > 0 {
+		r.RequestSHA256 = hex.EncodeToString(e.request.Sum(nil))
+	}
+	if r.ResponseBytes > 0 {
+		r.ResponseSHA256 = hex.EncodeToString(e.response.Sum(nil))
+	}
+	a.err = a.log.Write(&r)
+	if a.err != nil {
+		auditFailed.Add(1)
+		logrus.Errorf("Failed to write audit record corrID[%s] error[%v]", r.CorrID, a.err)
+	}
+}
+
+// failClosing tells if traffic stops while records cannot be written.
+func (a *auditor) failClosing() bool {
+	return a != nil && a.failClosed
+}
+
+// failing returns the error of the last record written if traffic must stop for it, nil otherwise.
+func (a *auditor) failing() error {
+	if a == nil || !a.failClosed {
+		return nil
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.err
+}
+
+// connected records a connection to bridge, which tries a log that failed again.
+func (a *auditor) connected(bridgeURL string) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.write(&auditEntry{record: audit.Record{Kind: "connect", URL: bridgeURL}, request: sha256.New(), response: sha256.New()})
+}
+
+// disconnected records the calls and connections still pending when bridge disconnects, as failed.
+func (a *auditor) disconnected() {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	for _, pending := range []map[string]*auditEntry{a.calls, a.conns} {
+		for id, e := range pending {
+			delete(pending, id)
+			if e.record.Kind == "websocket_open" {
+				e.record.Kind = "websocket_close"
+			}
+			if e.record.Error == "" {
+				e.record.Error = "bridge disconnected"
+			}
+			a.write(e)
+		}
+	}
+}
+
+// message records a websocket message of the connection.
+func (a *auditor) message(conn *auditEntry, direction string, msg string) {
+	e := &auditEntry{record: conn.record, request: sha256.New(), response: sha256.New()}
+	e.record.Kind, e.record.Direction, e.record.Error = "websocket_msg", direction, ""
+	if direction == "in" {
+		e.in([]byte(msg))
+	} else {
+		e.out([]byte(msg))
+	}
+	a.write(e)
+}
+
+// matched sets the whitelist rule of the call or connection with the id.
+func (a *auditor) matched(id string, rule *config.WhitelistConfig) {
+	if a == nil || rule == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if e, present := a.calls[id]; present {
+		e.record.Rule = rule.String()
+	} else if e, present := a.conns[id]; present {
+		e.record.Rule = rule.String()
+	}
+}
+
+// dlp adds a data loss prevention action taken on the call with the id.
+func (a *auditor) dlp(id string, action string) {
+	if a == nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if e, present := a.calls[id]; present {
+		e.record.DLP = append(e.record.DLP, action)
+	}
+}
+
+// in records a packet from bridge.
+func (a *auditor) in(p *proto.Packet) {
+	if a == nil {
+		return
+	}
+	args := p.Args
+	if args == nil {
+		args = &proto.Args{}
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	switch p.Method {
+	case proto.HTTP, proto.GRPC:
+		kind := "http"
+		if p.Method == proto.GRPC {
+			kind = "grpc"
+		}
+		e := newAuditEntry(kind, p.CorrID, args)
+		if u, err := args.UrlTransform(); err == nil {
+			e.record.URL = u
+		}
+		e.in(args.Body)
+		a.calls[p.CorrID] = e
+	case proto.HTTP_BODY:
+		if e, present := a.calls[p.CorrID]; present {
+			e.in(args.Body)
+		}
+	case proto.OPEN_WEBSOCKET:
+		e := newAuditEntry("websocket_open", p.CorrID, args)
+		e.record.ID = args.WSID
+		if u, err := args.WsUrlTransform(); err == nil {
+			e.record.URL = u.String()
+		}
+		a.conns[args.WSID] = e
+	case proto.WEBSOCKET_MSG:
+		if e, present := a.conns[args.WSID]; present {
+			a.message(e, "in", args.Msg)
+		}
+	case proto.CLOSE_WEBSOCKET:
+		if e, present := a.conns[args.WSID]; present {
+			delete(a.conns, args.WSID)
+			e.record.Kind, e.record.Direction = "websocket_close", "in"
+			a.write(e)
+		}
+	case proto.OPEN_TCP:
+		e := newAuditEntry("tcp", p.CorrID, args)
+		e.record.ID, e.record.URL = args.TCPID, args.URL
+		a.conns[args.TCPID] = e
+	case proto.TCP_DATA:
+		if e, present := a.conns[args.TCPID]; present {
+			e.in(args.Body)
+		}
+	case proto.CLOSE_TCP:
+		if e, present := a.conns[args.TCPID]; present {
+			delete(a.conns, args.TCPID)
+			a.write(e)
+		}
+	}
+}
+
+// out records a packet to bridge.
+func (a *auditor) out(p *proto.Packet) {
+	if a == nil || p.Args == nil {
+		return
+	}
+	args := p.Args
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	switch p.Method {
+	case proto.HTTP_RESULT:
+		if e, present := a.calls[p.CorrID]; present {
+			e.record.Status = int(args.StatusCode)
+			e.record.Error = args.Exception
+			e.out(args.Body)
+			if !args.Stream {
+				delete(a.calls, p.CorrID)
+				a.write(e)
+			}
+		}
+	case proto.HTTP_BODY:
+		if e, present := a.calls[p.CorrID]; present {
+			e.out(args.Body)
+			if args.Exception != "" {
+				e.record.Error = args.Exception
+			}
+			if args.EOF {
+				delete(a.calls, p.CorrID)
+				a.write(e)
+			}
+		}
+	case proto.OPEN_WEBSOCKET_RESULT:
+		if e, present := a.conns[args.WSID]; present {
+			e.record.Error = args.Exception
+			a.write(e)
+			if args.Exception != "" {
+				delete(a.conns, args.WSID)
+			}
+		}
+	case proto.WEBSOCKET_MSG:
+		if e, present := a.conns[args.WSID]; present {
+			a.message(e, "out", args.Msg)
+		}
+	case proto.CLOSE_WEBSOCKET:
+		if e, present := a.conns[args.WSID]; present {
+			delete(a.conns, args.WSID)
+			e.record.Kind, e.record.Direction = "websocket_close", "out"
+			a.write(e)
+		}
+	case proto.OPEN_TCP_RESULT:
+		if e, present := a.conns[args.TCPID]; present && args.Exception != "" {
+			delete(a.conns, args.TCPID)
+			e.record.Error = args.Exception
+			a.write(e)
+		}
+	case proto.TCP_DATA:
+		if e, present := a.conns[args.TCPID]; present {
+			e.out(args.Body)
+		}
+	case proto.CLOSE_TCP:
+		if e, present := a.conns[args.TCPID]; present {
+			delete(a.conns, args.TCPID)
+			a.write(e)
+		}
+	}
+}
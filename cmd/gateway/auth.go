@@ -0,0 +1,55 @@
+package main
+
+import (
+	"expvar"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"github.com/bcmmacro/bridging-go/internal/auth"
+	"github.com/bcmmacro/bridging-go/internal/seal"
+)
+
+// sealRejected counts the tampered or replayed packets from bridge.
+var sealRejected = expvar.NewInt("gateway_seal_rejected")
+
+// authTimeout is how long bridge has to send its challenge.
+const authTimeout = 10 * time.Second
+
+// answerChallenge signs the challenge which bridge sends right after connecting.
+func answerChallenge(wss *websocket.Conn, keyID string, key []byte) error {
+	deadline := time.Now().Add(authTimeout)
+	wss.SetReadDeadline(deadline)
+	var challenge auth.Challenge
+	if err := wss.ReadJSON(&challenge); err != nil {
+		return err
+	}
+	wss.SetReadDeadline(time.Time{})
+	wss.SetWriteDeadline(deadline)
+	if err := wss.WriteJSON(auth.Answer(challenge, keyID, key, time.Now())); err != nil {
+		return err
+	}
+	wss.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// startSession exchanges the salts of a sealed session with bridge, which sends its salt first.
+func startSession(wss *websocket.Conn, keys *seal.Keys) (*seal.Session, error) {
+	own, err := seal.NewHello()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(authTimeout)
+	wss.SetReadDeadline(deadline)
+	var peer seal.Hello
+	if err := wss.ReadJSON(&peer); err != nil {
+		return nil, err
+	}
+	wss.SetReadDeadline(time.Time{})
+	wss.SetWriteDeadline(deadline)
+	if err := wss.WriteJSON(own); err != nil {
+		return nil, err
+	}
+	wss.SetWriteDeadline(time.Time{})
+	return keys.NewSession(own, peer)
+}
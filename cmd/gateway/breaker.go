@@ -0,0 +1,74 @@
+package main
+
+import (
+	"expvar"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/internal/flow"
+)
+
+// breakerStates are the last breakers made, published once so that making breakers again does not panic.
+var breakerStates atomic.Value
+
+func init() {
+	expvar.Publish("gateway_breakers", expvar.Func(func() interface{} {
+		if b, ok := breakerStates.Load().(*breakers); ok {
+			return b.states()
+		}
+		return map[string]string{}
+	}))
+}
+
+// breakers are the circuit breakers per downstream netloc and per whitelist rule.
+type breakers struct {
+	netlocs map[string]*flow.Breaker
+	rules   map[*config.WhitelistConfig]*flow.Breaker
+}
+
+func newBreakers(conf *config.Config) *breakers {
+	b := &breakers{netlocs: map[string]*flow.Breaker{}, rules: map[*config.WhitelistConfig]*flow.Breaker{}}
+	for netloc, breaker := range conf.NetlocBreakers {
+		if breaker.Failures > 0 {
+			b.netlocs[netloc] = flow.NewBreaker(breaker.Failures, time.Duration(breaker.OpenMs)*time.Millisecond, breaker.Probes)
+		}
+	}
+	for _, rule := range conf.WhitelistMap.Rules() {
+		if rule.Breaker.Failures > 0 {
+			b.rules[rule] = flow.NewBreaker(rule.Breaker.Failures, time.Duration(rule.Breaker.OpenMs)*time.Millisecond, rule.Breaker.Probes)
+		}
+	}
+	breakerStates.Store(b)
+	return b
+}
+
+// allow checks the breaker of the rule, or of the netloc if the rule has none,
+// report must be called with the outcome of the call.
+func (b *breakers) allow(netloc string, rule *config.WhitelistConfig) (report func(outcome flow.Outcome), err error) {
+	breaker, present := b.rules[rule]
+	if !present {
+		breaker, present = b.netlocs[netloc]
+	}
+	if !present {
+		return func(flow.Outcome) {}, nil
+	}
+	report, ok := breaker.Allow()
+	if !ok {
+		return nil, flow.ErrBreakerOpen
+	}
+	return report, nil
+}
+
+// states is the state of each breaker, for monitoring.
+func (b *breakers) states() interface{} {
+	ret := map[string]string{}
+	for netloc, breaker := range b.netlocs {
+		ret["netloc:"+netloc] = breaker.State()
+	}
+	for rule, breaker := range b.rules {
+		ret["rule:"+strings.Join(rule.Netloc, ",")+strings.Join(rule.Path, ",")] = breaker.State()
+	}
+	return ret
+}
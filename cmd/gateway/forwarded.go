@@ -0,0 +1,41 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/bcmmacro/bridging-go/internal/proto"
+)
+
+// setForwarded tells the downstream service about the original request with the X-Forwarded-* headers
+// and the RFC 7239 Forwarded header. Bridge has resolved the client behind its trusted proxies already.
+func setForwarded(h http.Header, args *proto.Args) {
+	if args.Client == "" {
+		return
+	}
+	client := args.Client
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		client = host
+	}
+
+	h.Set("X-Forwarded-For", client)
+	forwarded := "for=" + forwardedNode(client)
+	if args.Host != "" {
+		h.Set("X-Forwarded-Host", args.Host)
+		forwarded += `;host="` + args.Host + `"`
+	}
+	if args.Scheme != "" {
+		h.Set("X-Forwarded-Proto", args.Scheme)
+		forwarded += ";proto=" + args.Scheme
+	}
+	h.Set("Forwarded", forwarded)
+}
+
+// forwardedNode quotes IPv6 addresses as required by RFC 7239 section 6.
+func forwardedNode(ip string) string {
+	if strings.Contains(ip, ":") {
+		return `"[` + ip + `]"`
+	}
+	return ip
+}
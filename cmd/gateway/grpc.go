@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/internal/flow"
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+const bodyQueueSize = 256
+
+// gRPC status codes, see https://grpc.github.io/grpc/core/md_doc_statuscodes.html
+const (
+	grpcUnknown          = 2
+	grpcDeadlineExceeded = 4
+	grpcPermissionDenied = 7
+	grpcInternal         = 13
+	grpcUnavailable      = 14
+	grpcDataLoss         = 15
+)
+
+var errBodyAborted = errors.New("request body aborted")
+
+// reqBody is a request body streamed from bridge. Chunks are queued so that a slow downstream
+// service does not block the bridge read loop.
+type reqBody struct {
+	queue  *flow.Queue
+	reader *io.PipeReader
+	writer *io.PipeWriter
+}
+
+// newH2CTransport dials downstream gRPC services over HTTP/2, with tls and the settings of their netlocs
+// for those in netloc_tls, and in cleartext otherwise.
+func newH2CTransport(conf config.Transport, tlsConfigs *tlsConfigs) *http2.Transport {
+	dialer := &net.Dialer{
+		Timeout:   orDefault(conf.DialTimeoutMs, 30*time.Second),
+		KeepAlive: orDefault(conf.KeepAliveMs, 30*time.Second),
+	}
+	dialTLS := tlsConfigs.dialTLS(dialer, orDefault(conf.TLSHandshakeTimeoutMs, 10*time.Second), []string{"h2"})
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, cfg *tls.Config) (net.Conn, error) {
+			if tlsConfigs.get(addr) != nil {
+				return dialTLS(ctx, network, addr)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+	}
+}
+
+// openBody registers the request body before the call starts, so that no chunk from bridge is missed.
+func (gw *Gateway) openBody(corrID string) *reqBody {
+	pr, pw := io.Pipe()
+	b := &reqBody{queue: flow.NewQueue(bodyQueueSize, flow.PolicyDisconnect), reader: pr, writer: pw}
+	gw.mutex.Lock()
+	gw.bodies[corrID] = b
+	gw.mutex.Unlock()
+	go b.pump()
+	return b
+}
+
+func (gw *Gateway) closeBody(corrID string) {
+	gw.mutex.Lock()
+	b, present := gw.bodies[corrID]
+	delete(gw.bodies, corrID)
+	gw.mutex.Unlock()
+	if present {
+		b.queue.Close()
+		b.reader.Close()
+	}
+}
+
+// pump writes the queued chunks into the request body.
+func (b *reqBody) pump() {
+	for {
+		item, ok := b.queue.Pop()
+		if !ok {
+			b.writer.CloseWithError(errBodyAborted)
+			return
+		}
+		args := item.(*proto.Args)
+		if len(args.Body) > 0 {
+			if _, err := b.writer.Write(args.Body); err != nil {
+				return
+			}
+		}
+		if args.EOF {
+			if args.Exception != "" {
+				b.writer.CloseWithError(errors.New(args.Exception))
+			} else {
+				b.writer.Close()
+			}
+			return
+		}
+	}
+}
+
+// handleBody queues a request body chunk from bridge.
+func (gw *Gateway) handleBody(ctx context.Context, corrID string, args *proto.Args) {
+	gw.mutex.Lock()
+	b, present := gw.bodies[corrID]
+	gw.mutex.Unlock()
+	if !present {
+		return
+	}
+	if _, err := b.queue.Push(args); err == flow.ErrOverflow {
+		log.Ctx(ctx).Warnf("Downstream service is too slow to read request body, aborting")
+		b.queue.Close()
+	}
+}
+
+// handleGRPC forwards a gRPC call to the downstream service over HTTP/2. Request messages from bridge
+// are streamed into the request body while the response is streamed back.
+func (gw *Gateway) handleGRPC(ctx context.Context, corrID string, args *proto.Args, body *reqBody) {
+	logger := log.Ctx(ctx)
+	ctx, done := gw.cancellable(ctx, corrID)
+	defer done()
+	defer gw.closeBody(corrID)
+
+	url, err := args.UrlTransform()
+	if err != nil {
+		logger.Warn("Failed to transform url to it's intended destination")
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(400))}
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, args.Method, url, body.reader)
+	if err != nil {
+		logger.Warn("Failed to parse args into a http request obj")
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, proto.MakeHTTPErrprRespArgs(400))}
+		return
+	}
+	for k, v := range args.Headers {
+		for _, vv := range v {
+			req.Header.Add(k, vv)
+		}
+	}
+	setForwarded(req.Header, args)
+
+	// gRPC is whitelisted per service and method
+	rule, err := gw.firewall(ctx, corrID, config.GRPC, req.URL, req.Header)
+	if err != nil {
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, grpcErrorArgs(grpcPermissionDenied, err.Error()))}
+		return
+	}
+	gw.audit.matched(corrID, rule)
+	// services in netloc_tls are reached over tls, the whitelist is checked on the url as received
+	gw.tls.upgrade(req.URL)
+	release, err := gw.limits.acquire(ctx, req.URL.Host, rule)
+	if err != nil {
+		logger.Warnf("Rejected by concurrency limit [%v]", err)
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, grpcErrorArgs(grpcUnavailable, err.Error()))}
+		return
+	}
+	defer release()
+
+	report, err := gw.breakers.allow(req.URL.Host, rule)
+	if err != nil {
+		logger.Warnf("Rejected by circuit breaker of [%s]", req.URL.Host)
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, grpcErrorArgs(grpcUnavailable, err.Error()))}
+		return
+	}
+
+	resp, err := gw.h2c.RoundTrip(req)
+	if err != nil {
+		report(outcome(ctx, resp, err))
+		logger.Warnf("Failed to get a response from grpc req[%v]", err)
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.HTTP_RESULT, grpcErrorArgs(grpcUnavailable, err.Error()))}
+		return
+	}
+	defer resp.Body.Close()
+	// the status of the call is in the trailers, known once the response ends
+	err = gw.stream(ctx, corrID, resp)
+	report(grpcOutcome(ctx, resp, err))
+}
+
+// grpcOutcome tells how a gRPC call went, for the circuit breaker. A call fails by its grpc-status, the HTTP status
+// is 200 for errors as well. Statuses which are up to the caller, like NOT_FOUND, do not count as failures.
+func grpcOutcome(ctx context.Context, resp *http.Response, err error) flow.Outcome {
+	if o := outcome(ctx, resp, err); o != flow.Succeeded {
+		return o
+	}
+	status := resp.Trailer.Get("Grpc-Status")
+	if status == "" {
+		// a trailers-only response has the status in its headers
+		status = resp.Header.Get("Grpc-Status")
+	}
+	code, err := strconv.Atoi(status)
+	if err != nil {
+		// no status, the call did not end properly
+		return flow.Failed
+	}
+	switch code {
+	case grpcUnknown, grpcDeadlineExceeded, grpcInternal, grpcUnavailable, grpcDataLoss:
+		return flow.Failed
+	}
+	return flow.Succeeded
+}
+
+// grpcErrorArgs makes a trailers-only gRPC response.
+func grpcErrorArgs(code int, msg string) *proto.Args {
+	return &proto.Args{
+		StatusCode: http.StatusOK,
+		Headers: map[string][]string{
+			"Content-Type": {"application/grpc"},
+			"Grpc-Status":  {strconv.Itoa(code)},
+			"Grpc-Message": {msg},
+		},
+	}
+}
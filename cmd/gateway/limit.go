@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/internal/flow"
+)
+
+// limiters bound the concurrent calls per downstream netloc and per whitelist rule.
+type limiters struct {
+	netlocs map[string]*flow.Limiter
+	rules   map[*config.WhitelistConfig]*flow.Limiter
+}
+
+func newLimiters(conf *config.Config) *limiters {
+	l := &limiters{netlocs: map[string]*flow.Limiter{}, rules: map[*config.WhitelistConfig]*flow.Limiter{}}
+	for netloc, limit := range conf.NetlocLimits {
+		if limiter := newLimiter(limit); limiter != nil {
+			l.netlocs[netloc] = limiter
+		}
+	}
+	for _, rule := range conf.WhitelistMap.Rules() {
+		if limiter := newLimiter(rule.Limit); limiter != nil {
+			l.rules[rule] = limiter
+		}
+	}
+	return l
+}
+
+// newLimiter returns nil if the concurrency is unlimited.
+func newLimiter(limit config.Limit) *flow.Limiter {
+	if limit.MaxConcurrency <= 0 {
+		return nil
+	}
+	return flow.NewLimiter(limit.MaxConcurrency, limit.QueueSize, time.Duration(limit.QueueTimeoutMs)*time.Millisecond)
+}
+
+// acquire takes a slot of the rule and then of the netloc, release frees both.
+func (l *limiters) acquire(ctx context.Context, netloc string, rule *config.WhitelistConfig) (release func(), err error) {
+	var held []*flow.Limiter
+	release = func() {
+		for _, limiter := range held {
+			limiter.Release()
+		}
+	}
+	for _, limiter := range []*flow.Limiter{l.rules[rule], l.netlocs[netloc]} {
+		if limiter == nil {
+			continue
+		}
+		if err := limiter.Acquire(ctx); err != nil {
+			release()
+			return nil, err
+		}
+		held = append(held, limiter)
+	}
+	return release, nil
+}
@@ -9,12 +9,16 @@ import (
 	"os"
 
 	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/library/metrics"
 	"github.com/sirupsen/logrus"
 )
 
 func main() {
 	conf := argParse(os.Args)
-	gw := NewGateway(&conf.WhitelistMap)
+	if conf.MetricsAddr != "" {
+		metrics.Serve(conf.MetricsAddr)
+	}
+	gw := NewGateway(conf)
 	gw.Run(conf)
 }
 
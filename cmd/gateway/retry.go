@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/config"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+// retryReserve is the number of retries allowed at once regardless of the retry budget.
+const retryReserve = 10
+
+var (
+	retries              = expvar.NewInt("gateway_retries")
+	retryBudgetExhausted = expvar.NewInt("gateway_retry_budget_exhausted")
+)
+
+// idempotentMethods can be retried safely, see RFC 7231 section 4.2.2.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+func retryable(policy config.Retry, method string) bool {
+	if idempotentMethods[method] {
+		return true
+	}
+	for _, m := range policy.Methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+// do sends the request, and retries it with backoff as the retry policy of the rule and the retry budget allow.
+// Only calls which get no response are retried, so nothing of the response has been sent to bridge yet.
+func (gw *Gateway) do(ctx context.Context, client *http.Client, req *http.Request, rule *config.WhitelistConfig) (*http.Response, error) {
+	logger := log.Ctx(ctx)
+	policy := gw.conf.RetryOf(rule)
+	gw.retryBudget.Deposit()
+	backoff := time.Duration(policy.BackoffMs) * time.Millisecond
+	maxBackoff := time.Duration(policy.MaxBackoffMs) * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		resp, err := client.Do(req)
+		if err == nil || ctx.Err() != nil || attempt > policy.Attempts || !retryable(policy, req.Method) {
+			return resp, err
+		}
+		// a request body which cannot be rewound has been consumed
+		if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+			return resp, err
+		}
+		if !gw.retryBudget.Withdraw() {
+			logger.Warnf("Retry budget is used up, not retrying http req after [%v]", err)
+			retryBudgetExhausted.Add(1)
+			return resp, err
+		}
+
+		logger.Warnf("Retry [%d/%d] of http req in [%v] after [%v]", attempt, policy.Attempts, backoff, err)
+		retries.Add(1)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if maxBackoff > 0 && backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+
+		// the context of the request holds its trace, which forwards the 1xx responses of the retry too
+		req = req.Clone(req.Context())
+		if req.GetBody != nil {
+			if req.Body, err = req.GetBody(); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/url"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/flow"
+	"github.com/bcmmacro/bridging-go/internal/proto"
+	"github.com/bcmmacro/bridging-go/library/log"
+)
+
+// tcpQueueSize is the window in chunks granted to bridge for each tcp connection.
+const tcpQueueSize = 64
+
+// tcpSession is a downstream tcp connection. Data from bridge is queued and written by its own goroutine,
+// so that a slow downstream service does not block the bridge read loop, and data to bridge is sent
+// within the window granted by bridge.
+type tcpSession struct {
+	conn   net.Conn
+	queue  *flow.Queue
+	credit *flow.Credit
+}
+
+func (s *tcpSession) close() {
+	s.conn.Close()
+	s.credit.Close()
+	s.queue.Close()
+}
+
+// handleOpenTCP opens a raw tcp connection with the downstream service, and forwards what it reads to bridge.
+func (gw *Gateway) handleOpenTCP(ctx context.Context, corrID string, args *proto.Args) {
+	logger := log.Ctx(ctx)
+	tcpID := args.TCPID
+
+	target, err := url.Parse(args.URL)
+	if err == nil && !gw.conf.TCPWhitelist[target.Host] {
+		logger.Warnf("forbidden tcp [%v]", target.Host)
+		err = errors.New("forbidden")
+	}
+	if err != nil {
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.OPEN_TCP_RESULT, &proto.Args{TCPID: tcpID, Exception: err.Error()})}
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", target.Host, 10*time.Second)
+	if err != nil {
+		logger.Warnf("Failed to open tcp connection with destination[%v]", target.Host)
+		gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.OPEN_TCP_RESULT, &proto.Args{TCPID: tcpID, Exception: err.Error()})}
+		return
+	}
+	logger.Infof("Connected tcp [%v] for client [%v]", target.Host, args.Client)
+
+	// the window of bridge comes with the open, a bridge which sends none is not limited
+	session := &tcpSession{
+		conn:   conn,
+		queue:  flow.NewQueue(tcpQueueSize, flow.PolicyDisconnect),
+		credit: flow.NewCredit(args.Credit),
+	}
+	gw.mutex.Lock()
+	gw.tcps[tcpID] = session
+	gw.mutex.Unlock()
+
+	defer func() {
+		logger.Infof("Disconnected downstream tcp [%v]", target.Host)
+		session.close()
+		gw.mutex.Lock()
+		delete(gw.tcps, tcpID)
+		gw.mutex.Unlock()
+	}()
+
+	gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.OPEN_TCP_RESULT, &proto.Args{TCPID: tcpID, Credit: tcpQueueSize})}
+	go gw.writeTCP(ctx, corrID, tcpID, session)
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			if !session.credit.Acquire() {
+				break
+			}
+			data := append([]byte(nil), buf[:n]...)
+			gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.TCP_DATA, &proto.Args{TCPID: tcpID, Body: data})}
+		}
+		if err != nil {
+			logger.Infof("Closing tcp connection ID [%v] [%v]", tcpID, err)
+			break
+		}
+	}
+	gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.CLOSE_TCP, &proto.Args{TCPID: tcpID})}
+}
+
+// writeTCP writes the queued data from bridge to the downstream tcp connection, and grants the consumed window
+// back to bridge. The connection is closed once the queue is closed and drained.
+func (gw *Gateway) writeTCP(ctx context.Context, corrID string, tcpID string, session *tcpSession) {
+	logger := log.Ctx(ctx)
+	defer session.conn.Close()
+	var consumed int64
+	for {
+		data, ok := session.queue.Pop()
+		if !ok {
+			return
+		}
+		if _, err := session.conn.Write(data.([]byte)); err != nil {
+			logger.Warnf("Failed to forward tcp data to downstream service [%v]", err)
+			return
+		}
+		consumed++
+		if consumed >= tcpQueueSize/2 {
+			gw.wsChan <- wsChanItem{ctx: ctx, packet: createProtoPackage(corrID, proto.TCP_ACK, &proto.Args{TCPID: tcpID, Credit: consumed})}
+			consumed = 0
+		}
+	}
+}
+
+// handleTCPData queues the data from bridge for the downstream tcp connection without blocking.
+func (gw *Gateway) handleTCPData(ctx context.Context, args *proto.Args) {
+	gw.mutex.Lock()
+	session, present := gw.tcps[args.TCPID]
+	gw.mutex.Unlock()
+	if !present {
+		return
+	}
+	if _, err := session.queue.Push(args.Body); err == flow.ErrOverflow {
+		log.Ctx(ctx).Warnf("Bridge exceeded the tcp window, closing tcp connection ID [%v]", args.TCPID)
+		session.close()
+	}
+}
+
+// handleTCPAck grants the window of bridge back.
+func (gw *Gateway) handleTCPAck(args *proto.Args) {
+	gw.mutex.Lock()
+	session, present := gw.tcps[args.TCPID]
+	gw.mutex.Unlock()
+	if present {
+		session.credit.Grant(args.Credit)
+	}
+}
+
+// handleCloseTCP lets the queued data be written, then closes the downstream tcp connection.
+func (gw *Gateway) handleCloseTCP(args *proto.Args) {
+	gw.mutex.Lock()
+	session, present := gw.tcps[args.TCPID]
+	delete(gw.tcps, args.TCPID)
+	gw.mutex.Unlock()
+	if present {
+		session.credit.Close()
+		session.queue.Close()
+	}
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/bcmmacro/bridging-go/internal/config"
+)
+
+// tlsReloadInterval is how often the certificate files are checked for changes.
+const tlsReloadInterval = 10 * time.Second
+
+var tlsVersions = map[string]uint16{
+	"":    tls.VersionTLS12,
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfigs are the tls settings per downstream netloc.
+type tlsConfigs struct {
+	mutex   sync.Mutex
+	netlocs map[string]*tlsConfig
+}
+
+type tlsConfig struct {
+	conf     config.TLS
+	tls      *tls.Config
+	modTimes []time.Time // of the files, to tell when they change
+}
+
+func newTLSConfigs(netlocs map[string]config.TLS) (*tlsConfigs, error) {
+	t := &tlsConfigs{netlocs: map[string]*tlsConfig{}}
+	for netloc, conf := range netlocs {
+		c := &tlsConfig{conf: conf}
+		if err := c.load(); err != nil {
+			return nil, fmt.Errorf("failed to load tls of netloc[%s] error[%v]", netloc, err)
+		}
+		t.netlocs[netloc] = c
+	}
+	if len(t.netlocs) > 0 {
+		go t.watch()
+	}
+	return t, nil
+}
+
+func (c *tlsConfig) files() []string {
+	return []string{c.conf.CAFile, c.conf.CertFile, c.conf.KeyFile}
+}
+
+func modTimes(files []string) []time.Time {
+	ret := make([]time.Time, len(files))
+	for i, f := range files {
+		if f == "" {
+			continue
+		}
+		if info, err := os.Stat(f); err == nil {
+			ret[i] = info.ModTime()
+		}
+	}
+	return ret
+}
+
+// load reads the files into a tls.Config.
+func (c *tlsConfig) load() error {
+	minVersion, present := tlsVersions[c.conf.MinVersion]
+	if !present {
+		return fmt.Errorf("invalid min tls version[%s]", c.conf.MinVersion)
+	}
+	cfg := &tls.Config{ServerName: c.conf.ServerName, MinVersion: minVersion}
+	if len(c.conf.Pins) > 0 {
+		cfg.VerifyConnection = verifyPins(c.conf.Pins)
+	}
+	stamp := modTimes(c.files())
+	if c.conf.CAFile != "" {
+		pem, err := ioutil.ReadFile(c.conf.CAFile)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificate found in ca file[%s]", c.conf.CAFile)
+		}
+	}
+	if c.conf.CertFile != "" || c.conf.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.conf.CertFile, c.conf.KeyFile)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	c.tls = cfg
+	c.modTimes = stamp
+	return nil
+}
+
+// verifyPins checks the certificate of the peer against the pins.
+func verifyPins(pins []string) func(tls.ConnectionState) error {
+	return func(cs tls.ConnectionState) error {
+		if len(cs.PeerCertificates) == 0 {
+			return errors.New("no certificate to verify pins")
+		}
+		leaf := cs.PeerCertificates[0]
+		spki := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+		cert := sha256.Sum256(leaf.Raw)
+		for _, pin := range pins {
+			if pin == base64.StdEncoding.EncodeToString(spki[:]) || pin == base64.StdEncoding.EncodeToString(cert[:]) {
+				return nil
+			}
+		}
+		return fmt.Errorf("certificate of [%s] matches no pin", leaf.Subject)
+	}
+}
+
+// watch reloads the configs whose files change, a config which fails to reload is kept as it is.
+func (t *tlsConfigs) watch() {
+	for range time.Tick(tlsReloadInterval) {
+		t.mutex.Lock()
+		for netloc, c := range t.netlocs {
+			changed := false
+			for i, m := range modTimes(c.files()) {
+				changed = changed || !m.Equal(c.modTimes[i])
+			}
+			if !changed {
+				continue
+			}
+			if err := c.load(); err != nil {
+				logrus.Errorf("Failed to reload tls of netloc[%s] error[%v]", netloc, err)
+			} else {
+				logrus.Infof("Reloaded tls of netloc[%s]", netloc)
+			}
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// lookup returns the config of the netloc, a netloc without a port in netloc_tls stands for its port 443 too.
+// The caller holds the mutex.
+func (t *tlsConfigs) lookup(netloc string) (*tlsConfig, bool) {
+	c, present := t.netlocs[netloc]
+	if !present {
+		if host, port, err := net.SplitHostPort(netloc); err == nil && port == "443" {
+			c, present = t.netlocs[host]
+		}
+	}
+	return c, present
+}
+
+// get returns a copy of the config of the netloc, nil if there is none.
+func (t *tlsConfigs) get(netloc string) *tls.Config {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	c, present := t.lookup(netloc)
+	if !present {
+		return nil
+	}
+	return c.tls.Clone()
+}
+
+// upgrade switches the url to https or wss if its netloc is reached over tls.
+func (t *tlsConfigs) upgrade(u *url.URL) {
+	t.mutex.Lock()
+	_, present := t.lookup(u.Host)
+	t.mutex.Unlock()
+	if !present {
+		return
+	}
+	switch u.Scheme {
+	case "http":
+		u.Scheme = "https"
+	case "ws":
+		u.Scheme = "wss"
+	}
+}
+
+// dialTLS dials a downstream service over tls with the config of its netloc, offering the protocols by ALPN.
+func (t *tlsConfigs) dialTLS(dialer *net.Dialer, handshakeTimeout time.Duration, protos []string) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		cfg := t.get(addr)
+		if cfg == nil {
+			cfg = &tls.Config{}
+		}
+		if cfg.ServerName == "" {
+			cfg.ServerName, _, _ = net.SplitHostPort(addr)
+		}
+		cfg.NextProtos = protos
+
+		ctx, cancel := context.WithTimeout(ctx, handshakeTimeout)
+		defer cancel()
+		tlsConn := tls.Client(conn, cfg)
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return tlsConn, nil
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/config"
+)
+
+func orDefault(ms int, d time.Duration) time.Duration {
+	if ms > 0 {
+		return time.Duration(ms) * time.Millisecond
+	}
+	return d
+}
+
+// newTransport makes the transport shared by all http calls to downstream services,
+// its defaults follow http.DefaultTransport except more idle connections are kept per host.
+// Services are dialed over tls with the settings of their netlocs.
+func newTransport(conf config.Transport, tlsConfigs *tlsConfigs) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   orDefault(conf.DialTimeoutMs, 30*time.Second),
+		KeepAlive: orDefault(conf.KeepAliveMs, 30*time.Second),
+	}
+	maxIdleConns := conf.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = 100
+	}
+	maxIdleConnsPerHost := conf.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = 16
+	}
+	return &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		DialTLSContext:        tlsConfigs.dialTLS(dialer, orDefault(conf.TLSHandshakeTimeoutMs, 10*time.Second), []string{"h2", "http/1.1"}),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		MaxConnsPerHost:       conf.MaxConnsPerHost,
+		IdleConnTimeout:       orDefault(conf.IdleConnTimeoutMs, 90*time.Second),
+		ResponseHeaderTimeout: orDefault(conf.ResponseHeaderTimeoutMs, 0),
+		ExpectContinueTimeout: time.Second,
+	}
+}
+
+// callTimeout cancels a call to a downstream service once it takes longer than its timeout.
+type callTimeout struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	timer  *time.Timer
+	fired  int32
+}
+
+// startTimeout starts the timeout of a call, timeout <= 0 means no timeout.
+func startTimeout(ctx context.Context, timeout time.Duration) *callTimeout {
+	t := &callTimeout{}
+	t.ctx, t.cancel = context.WithCancel(ctx)
+	if timeout > 0 {
+		t.timer = time.AfterFunc(timeout, func() {
+			atomic.StoreInt32(&t.fired, 1)
+			t.cancel()
+		})
+	}
+	return t
+}
+
+// disarm stops the timer, e.g. once a response is streamed, which may never finish.
+func (t *callTimeout) disarm() {
+	if t.timer != nil {
+		t.timer.Stop()
+	}
+}
+
+func (t *callTimeout) stop() {
+	t.disarm()
+	t.cancel()
+}
+
+// expired tells if the call failed for its timeout, or for a timeout of the transport.
+func (t *callTimeout) expired(err error) bool {
+	if atomic.LoadInt32(&t.fired) == 1 {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
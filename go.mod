@@ -9,6 +9,11 @@ require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/rs/cors v1.8.2
 	github.com/sirupsen/logrus v1.8.1
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
 )
 
-require golang.org/x/sys v0.0.0-20210423082822-04245dca01da // indirect
+require (
+	golang.org/x/sys v0.13.0 // indirect
+	golang.org/x/text v0.13.0 // indirect
+)
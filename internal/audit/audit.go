@@ -0,0 +1,263 @@
+// Package audit writes a tamper-evident log of the traffic through gateway, one json record per line.
+// Each record holds the hash of the record before it, so that changing, dropping or reordering records breaks
+// the chain. With a key the hashes are HMACs, which cannot be recomputed by whoever rewrites the files.
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bcmmacro/bridging-go/internal/auth"
+)
+
+const (
+	// current is the file being written, rotated files are named audit-<time>.log and sort before it.
+	current   = "audit.log"
+	hashEmpty = `"hash":""}`
+)
+
+// Record is an http or gRPC call, a websocket message, or a tcp connection.
+type Record struct {
+	Seq            uint64         `json:"seq"`
+	Time           string         `json:"time"`
+	Kind           string         `json:"kind"` // http, grpc, websocket_open, websocket_msg, websocket_close, tcp or connect to bridge
+	CorrID         string         `json:"corr_id"`
+	ID             string         `json:"id,omitempty"`        // of the websocket or tcp connection
+	Direction      string         `json:"direction,omitempty"` // of a websocket message, in to or out of the private DC
+	Client         string         `json:"client,omitempty"`
+	Identity       *auth.Identity `json:"identity,omitempty"`
+	Method         string         `json:"method,omitempty"`
+	URL            string         `json:"url,omitempty"`
+	Rule           string         `json:"rule,omitempty"` // the whitelist rule which allowed it
+	Status         int            `json:"status,omitempty"`
+	Error          string         `json:"error,omitempty"`
+	RequestBytes   int64          `json:"request_bytes"`
+	ResponseBytes  int64          `json:"response_bytes"`
+	RequestSHA256  string         `json:"request_sha256,omitempty"`
+	ResponseSHA256 string         `json:"response_sha256,omitempty"`
+	DLP            []string       `json:"dlp,omitempty"` // data loss prevention actions taken
+	Prev           string         `json:"prev"`
+	Hash           string         `json:"hash"` // of the record with an empty hash, must be the last field
+}
+
+// Log appends records to rotating files in a directory.
+type Log struct {
+	dir      string
+	maxSize  int64 // bytes of a file before it is rotated, 0 means never
+	maxFiles int   // rotated files kept, 0 means all
+	key      []byte
+	mutex    sync.Mutex
+	file     *os.File
+	size     int64
+	seq      uint64
+	last     string // hash of the last record
+}
+
+// Open opens the log in dir, the chain continues from the last record written.
+func Open(dir string, maxSize int64, maxFiles int, key []byte) (*Log, error) {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return nil, err
+	}
+	l := &Log{dir: dir, maxSize: maxSize, maxFiles: maxFiles, key: key}
+	files, err := Files(dir)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(files) - 1; i >= 0; i-- {
+		line, err := lastLine(files[i])
+		if err != nil {
+			return nil, err
+		}
+		if line == nil {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return nil, fmt.Errorf("failed to resume from the last record of [%s] error[%v]", files[i], err)
+		}
+		l.seq, l.last = r.Seq, r.Hash
+		break
+	}
+	return l, l.open()
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(filepath.Join(l.dir, current), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o640)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// Write chains the record after the last one and appends it.
+func (l *Log) Write(r *Record) error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	r.Seq = l.seq + 1
+	r.Time = time.Now().UTC().Format(time.RFC3339Nano)
+	r.Prev = l.last
+	r.Hash = ""
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	r.Hash = hashOf(l.key, data)
+	line := append(data[:len(data)-len(hashEmpty)], `"hash":"`+r.Hash+"\"}\n"...)
+
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	if err != nil {
+		// a partial line would break the chain for good, the record is dropped as a whole
+		if n > 0 {
+			l.file.Truncate(l.size)
+		}
+		return err
+	}
+	l.size += int64(n)
+	l.seq, l.last = r.Seq, r.Hash
+	return nil
+}
+
+// rotate renames the current file after the time, and removes the oldest files over maxFiles.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	name := "audit-" + time.Now().UTC().Format("20060102T150405.000000000") + ".log"
+	if err := os.Rename(filepath.Join(l.dir, current), filepath.Join(l.dir, name)); err != nil {
+		return err
+	}
+	if l.maxFiles > 0 {
+		// the current file is renamed, so these are all rotated
+		rotated, err := Files(l.dir)
+		if err != nil {
+			return err
+		}
+		for len(rotated) > l.maxFiles {
+			os.Remove(rotated[0])
+			rotated = rotated[1:]
+		}
+	}
+	return l.open()
+}
+
+func (l *Log) Close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return l.file.Close()
+}
+
+func hashOf(key []byte, data []byte) string {
+	if len(key) == 0 {
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Files returns the files of the log in dir in the order they were written.
+func Files(dir string) ([]string, error) {
+	rotated, err := filepath.Glob(filepath.Join(dir, "audit-*.log"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(rotated)
+	if _, err := os.Stat(filepath.Join(dir, current)); err == nil {
+		rotated = append(rotated, filepath.Join(dir, current))
+	}
+	return rotated, nil
+}
+
+// lastLine returns the last line of the file, nil if it is empty.
+func lastLine(file string) ([]byte, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	data = bytes.TrimRight(data, "\n")
+	if len(data) == 0 {
+		return nil, nil
+	}
+	return data[bytes.LastIndexByte(data, '\n')+1:], nil
+}
+
+// Summary is what Verify has checked.
+type Summary struct {
+	Records   int
+	FirstSeq  uint64
+	FirstPrev string // where the chain starts, empty unless older files were removed
+	LastSeq   uint64
+	LastHash  string
+}
+
+// Verify checks the chain through the files in order, and returns the first break found.
+func Verify(files []string, key []byte) (Summary, error) {
+	var s Summary
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return s, err
+		}
+		err = verifyFile(f, file, key, &s)
+		f.Close()
+		if err != nil {
+			return s, err
+		}
+	}
+	return s, nil
+}
+
+func verifyFile(f io.Reader, name string, key []byte, s *Summary) error {
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var r Record
+		if err := json.Unmarshal(line, &r); err != nil {
+			return fmt.Errorf("%s:%d: malformed record error[%v]", name, n, err)
+		}
+		suffix := `"hash":"` + r.Hash + `"}`
+		if !bytes.HasSuffix(line, []byte(suffix)) {
+			return fmt.Errorf("%s:%d: hash is not the last field", name, n)
+		}
+		data := append(append([]byte{}, line[:len(line)-len(suffix)]...), hashEmpty...)
+		if !hmac.Equal([]byte(hashOf(key, data)), []byte(strings.ToLower(r.Hash))) {
+			return fmt.Errorf("%s:%d: record seq[%d] does not match its hash", name, n, r.Seq)
+		}
+		if s.Records == 0 {
+			s.FirstSeq, s.FirstPrev = r.Seq, r.Prev
+		} else if r.Prev != s.LastHash || r.Seq != s.LastSeq+1 {
+			return fmt.Errorf("%s:%d: record seq[%d] does not follow seq[%d]", name, n, r.Seq, s.LastSeq)
+		}
+		s.Records++
+		s.LastSeq, s.LastHash = r.Seq, r.Hash
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,96 @@
+// Package auth authenticates gateway to bridge with a challenge-response handshake: bridge sends a nonce,
+// gateway signs the nonce and a timestamp with one of the keys known to bridge, using HMAC-SHA256.
+// The nonce is fresh for every connection, so a response cannot be replayed on another one.
+// It also signs the identity of the clients which bridge authenticates, for gateway and downstream services to trust.
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// MaxSkew is how far the timestamp of a response can be from the clock of bridge.
+const MaxSkew = time.Minute
+
+var (
+	ErrUnknownKey   = errors.New("unknown key")
+	ErrBadSignature = errors.New("bad signature")
+	ErrStale        = errors.New("stale timestamp")
+)
+
+// Challenge is sent by bridge right after gateway connects.
+type Challenge struct {
+	Nonce string `json:"nonce"`
+}
+
+// Response is the answer of gateway to a Challenge.
+type Response struct {
+	KeyID     string `json:"key_id"`
+	Timestamp int64  `json:"timestamp"` // unix seconds
+	Signature string `json:"signature"` // hex HMAC-SHA256 of "<nonce>.<timestamp>"
+}
+
+// Keys are the keys which gateway can sign with, by key id. More than one key is active while keys are rotated.
+type Keys map[string][]byte
+
+// ParseKeys parses keys like "2023-10:secret1,2023-11:secret2".
+func ParseKeys(s string) (Keys, error) {
+	keys := Keys{}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, ":")
+		if i <= 0 || i == len(kv)-1 {
+			// the secret is not logged
+			return nil, fmt.Errorf("invalid key, expecting <key id>:<secret>")
+		}
+		keys[kv[:i]] = []byte(kv[i+1:])
+	}
+	return keys, nil
+}
+
+func NewChallenge() (Challenge, error) {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		return Challenge{}, err
+	}
+	return Challenge{Nonce: base64.RawURLEncoding.EncodeToString(nonce)}, nil
+}
+
+func sign(key []byte, nonce string, timestamp int64) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(nonce + "." + strconv.FormatInt(timestamp, 10)))
+	return mac.Sum(nil)
+}
+
+// Answer signs the challenge with the key.
+func Answer(c Challenge, keyID string, key []byte, now time.Time) Response {
+	ts := now.Unix()
+	return Response{KeyID: keyID, Timestamp: ts, Signature: hex.EncodeToString(sign(key, c.Nonce, ts))}
+}
+
+// Verify checks the response to the challenge, the signature is compared in constant time.
+func (keys Keys) Verify(c Challenge, r Response, now time.Time) error {
+	key, present := keys[r.KeyID]
+	if !present {
+		return ErrUnknownKey
+	}
+	sig, err := hex.DecodeString(r.Signature)
+	if err != nil || !hmac.Equal(sig, sign(key, c.Nonce, r.Timestamp)) {
+		return ErrBadSignature
+	}
+	if d := now.Sub(time.Unix(r.Timestamp, 0)); d > MaxSkew || d < -MaxSkew {
+		return ErrStale
+	}
+	return nil
+}
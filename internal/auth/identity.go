@@ -0,0 +1,120 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// IdentityHeader is the identity of the client, base64url of its json.
+	IdentityHeader = "Bridging-Identity"
+	// IdentitySignatureHeader is "<key id>:<hex HMAC-SHA256 of IdentityHeader>".
+	IdentitySignatureHeader = "Bridging-Identity-Signature"
+	// IdentityTTL is how long signed identity headers are accepted.
+	IdentityTTL = time.Minute
+)
+
+var (
+	ErrExpired      = errors.New("expired identity")
+	ErrOtherRequest = errors.New("identity signed for another request")
+)
+
+// Identity is a client authenticated by bridge, signed for one request.
+type Identity struct {
+	Subject string   `json:"sub"`
+	Issuer  string   `json:"iss,omitempty"`
+	Roles   []string `json:"roles,omitempty"`
+	Scopes  []string `json:"scopes,omitempty"`
+	Via     string   `json:"via"` // api_key, jwt or introspection
+	Expiry  int64    `json:"exp"` // unix seconds
+	Request
+}
+
+// Request is the request an identity is signed for, as gateway whitelists it, so that the identity headers
+// cannot be replayed on another request.
+type Request struct {
+	CorrID string `json:"corr_id,omitempty"`
+	Method string `json:"method,omitempty"` // upper case http method, WEBSOCKET or GRPC
+	Netloc string `json:"netloc,omitempty"`
+	Path   string `json:"path,omitempty"`
+}
+
+// SignIdentity sets the identity headers signed for the request, which expire in IdentityTTL.
+func SignIdentity(h http.Header, id Identity, req Request, keyID string, key []byte, now time.Time) {
+	id.Expiry = now.Add(IdentityTTL).Unix()
+	id.Request = req
+	data, _ := json.Marshal(id)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	h.Set(IdentityHeader, payload)
+	h.Set(IdentitySignatureHeader, keyID+":"+hex.EncodeToString(mac.Sum(nil)))
+}
+
+// StripIdentity removes the identity headers, so that a client cannot claim one.
+func StripIdentity(h http.Header) {
+	h.Del(IdentityHeader)
+	h.Del(IdentitySignatureHeader)
+}
+
+// VerifyIdentity returns the identity in the headers signed for the request, nil if there is none.
+func (keys Keys) VerifyIdentity(h http.Header, req Request, now time.Time) (*Identity, error) {
+	payload := h.Get(IdentityHeader)
+	signature := h.Get(IdentitySignatureHeader)
+	if payload == "" && signature == "" {
+		return nil, nil
+	}
+	i := strings.Index(signature, ":")
+	if i < 0 {
+		return nil, ErrBadSignature
+	}
+	key, present := keys[signature[:i]]
+	if !present {
+		return nil, ErrUnknownKey
+	}
+	sig, err := hex.DecodeString(signature[i+1:])
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(payload))
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, ErrBadSignature
+	}
+	id, err := decodeIdentity(payload)
+	if err != nil {
+		return nil, err
+	}
+	if now.Unix() > id.Expiry {
+		return nil, ErrExpired
+	}
+	if id.Request != req {
+		return nil, ErrOtherRequest
+	}
+	return id, nil
+}
+
+// ParseIdentity returns the identity in the headers without verifying it, nil if there is none.
+func ParseIdentity(h http.Header) (*Identity, error) {
+	payload := h.Get(IdentityHeader)
+	if payload == "" {
+		return nil, nil
+	}
+	return decodeIdentity(payload)
+}
+
+func decodeIdentity(payload string) (*Identity, error) {
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return nil, err
+	}
+	var id Identity
+	if err := json.Unmarshal(data, &id); err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
@@ -4,34 +4,163 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
+	"github.com/bcmmacro/bridging-go/internal/auth"
+	"github.com/bcmmacro/bridging-go/internal/flow"
 	errs "github.com/bcmmacro/bridging-go/library/errors"
 	"github.com/bcmmacro/bridging-go/library/log"
 	"github.com/sirupsen/logrus"
 )
 
 type Config struct {
-	BridgeNetLoc string
-	BridgeToken  string
-	WhitelistMap WhitelistMap
+	BridgeNetLoc            string
+	BridgeToken             string
+	WhitelistMap            WhitelistMap
+	ShadowWhitelistMap      *WhitelistMap // candidate whitelist evaluated alongside, nil if there is none
+	WebsocketQueueSize      int
+	WebsocketOverflowPolicy flow.Policy
+	TCPWhitelist            map[string]bool // netlocs which can be reached with raw tcp
+	MaxResponseSize         int64           // max bytes of a buffered downstream response, 0 means unlimited
+	NetlocLimits            map[string]Limit
+	NetlocBreakers          map[string]Breaker
+	MetricsAddr             string // serve metrics at http://<addr>/debug/vars, disabled if empty
+	Retry                   Retry
+	RetryBudget             float64 // max ratio of retries to calls
+	Transport               Transport
+	TimeoutMs               int            // max time of a call to a downstream service, 0 means no timeout
+	NetlocTLS               map[string]TLS // netlocs which are reached over tls
+	BridgeTLS               *TLS           // how bridge is reached over wss, the defaults if nil
+	BridgeKeyID             string         // id of BridgeKey among the keys known to bridge
+	BridgeKey               string         // signs the challenge of bridge, bridge_token is sent if empty
+	SealKeys                string         // <key id>:<base64 key>,... packets on /bridge are sealed with, the first seals
+	IdentityKeys            string         // <key id>:<secret>,... bridge signs the identity of clients with
+	Audit                   *Audit         // audit log of the traffic, disabled if nil
 }
 
 type config struct {
-	BridgeNetLoc string            `json:"bridge_netloc"`
-	BridgeToken  string            `json:"bridge_token"`
-	Whitelist    []WhitelistConfig `json:"whitelist"`
+	BridgeNetLoc            string             `json:"bridge_netloc"`
+	BridgeToken             string             `json:"bridge_token"`
+	Whitelist               []WhitelistConfig  `json:"whitelist"`
+	ShadowWhitelist         []WhitelistConfig  `json:"shadow_whitelist"`
+	WebsocketQueueSize      int                `json:"websocket_queue_size"`
+	WebsocketOverflowPolicy string             `json:"websocket_overflow_policy"`
+	TCPWhitelist            []string           `json:"tcp_whitelist"`
+	MaxResponseSize         int64              `json:"max_response_size"`
+	NetlocLimits            map[string]Limit   `json:"netloc_limits"`
+	NetlocBreakers          map[string]Breaker `json:"netloc_breakers"`
+	MetricsAddr             string             `json:"metrics_addr"`
+	Retry                   Retry              `json:"retry"`
+	RetryBudget             float64            `json:"retry_budget"`
+	Transport               Transport          `json:"transport"`
+	TimeoutMs               int                `json:"timeout_ms"`
+	NetlocTLS               map[string]TLS     `json:"netloc_tls"`
+	BridgeTLS               *TLS               `json:"bridge_tls"`
+	BridgeKeyID             string             `json:"bridge_key_id"`
+	BridgeKey               string             `json:"bridge_key"`
+	SealKeys                string             `json:"seal_keys"`
+	IdentityKeys            string             `json:"identity_keys"`
+	Audit                   *Audit             `json:"audit"`
 }
 
-type WhitelistMap map[WhitelistEntry]bool
+// GRPC is the whitelist method of gRPC calls, a path is either /<service>/<method>,
+// or /<service>/* for all methods of the service.
+const GRPC = "GRPC"
+
+// WhitelistMap maps each allowed route to the rules it comes from, paths with * are matched as globs.
+type WhitelistMap struct {
+	routes map[WhitelistEntry][]*WhitelistConfig
+	globs  []globRoute
+	rules  []*WhitelistConfig
+	keys   auth.Keys // verify the identity of clients, which is not trusted if empty
+}
 
 type WhitelistConfig struct {
+	Name   string   `json:"name"` // of the rule in logs and audit records, optional
 	Netloc []string `json:"netloc"`
 	Method []string `json:"method"`
 	Scheme []string `json:"scheme"`
 	Path   []string `json:"path"`
+	Stream bool     `json:"stream"` // forward the response body as it arrives
+	// MaxResponseSize overrides Config.MaxResponseSize for the routes of this rule
+	MaxResponseSize int64 `json:"max_response_size"`
+	Limit                 // concurrency limit shared by the routes of this rule
+	// Breaker of the routes of this rule, it takes the place of the breaker of the netloc
+	Breaker Breaker `json:"breaker"`
+	// Retry overrides Config.Retry for the routes of this rule
+	Retry *Retry `json:"retry"`
+	// TimeoutMs overrides Config.TimeoutMs for the routes of this rule
+	TimeoutMs int `json:"timeout_ms"`
+	// Roles, Scopes and Subjects restrict the routes of this rule to clients authenticated by bridge
+	// which have any of the roles, all of the scopes, and are any of the subjects
+	Roles    []string `json:"roles"`
+	Scopes   []string `json:"scopes"`
+	Subjects []string `json:"subjects"`
+
+	order int // of the rule in the whitelist, the first rule which allows a route is taken
+}
+
+// Limit bounds the concurrent calls to downstream services, calls beyond wait in a queue.
+type Limit struct {
+	MaxConcurrency int `json:"max_concurrency"` // 0 means unlimited
+	QueueSize      int `json:"queue_size"`
+	QueueTimeoutMs int `json:"queue_timeout_ms"` // 0 means waiting until the call is cancelled
+}
+
+// Breaker opens after Failures consecutive failed calls to downstream services, i.e. errors or 5xx,
+// and rejects calls for OpenMs, then closes again if Probes calls in a row succeed.
+type Breaker struct {
+	Failures int `json:"failures"` // 0 means no breaker
+	OpenMs   int `json:"open_ms"`
+	Probes   int `json:"probes"`
+}
+
+// Retry retries calls to downstream services which fail to connect or get a response, for idempotent methods
+// and the extra Methods. The wait before each retry starts at BackoffMs and doubles up to MaxBackoffMs.
+type Retry struct {
+	Attempts     int      `json:"attempts"` // retries after the first call, 0 means no retry
+	BackoffMs    int      `json:"backoff_ms"`
+	MaxBackoffMs int      `json:"max_backoff_ms"`
+	Methods      []string `json:"methods"` // methods which are not idempotent but safe to retry, e.g. POST
+}
+
+// Transport tunes the connections to downstream services, 0 means the default.
+type Transport struct {
+	MaxIdleConns            int `json:"max_idle_conns"`
+	MaxIdleConnsPerHost     int `json:"max_idle_conns_per_host"`
+	MaxConnsPerHost         int `json:"max_conns_per_host"`
+	IdleConnTimeoutMs       int `json:"idle_conn_timeout_ms"`
+	KeepAliveMs             int `json:"keep_alive_ms"`
+	DialTimeoutMs           int `json:"dial_timeout_ms"`
+	TLSHandshakeTimeoutMs   int `json:"tls_handshake_timeout_ms"`
+	ResponseHeaderTimeoutMs int `json:"response_header_timeout_ms"`
+}
+
+// TLS is how a downstream service is reached over tls, the files are reloaded when they change.
+type TLS struct {
+	CAFile     string `json:"ca_file"`     // CA bundle, the system roots if empty
+	CertFile   string `json:"cert_file"`   // client certificate, for services which require mTLS
+	KeyFile    string `json:"key_file"`    // key of the client certificate
+	ServerName string `json:"server_name"` // SNI and the name verified, the host of the netloc if empty
+	MinVersion string `json:"min_version"` // 1.0, 1.1, 1.2 or 1.3, 1.2 if empty
+	// Pins are base64 SHA-256 digests of the certificate or of its public key (SPKI), the certificate
+	// presented must match one of them besides being verified against the CA
+	Pins []string `json:"pins"`
+}
+
+// Audit is a tamper-evident log of the requests, websocket messages and tcp connections through gateway,
+// written to rotating files in Dir.
+type Audit struct {
+	Dir        string `json:"dir"`
+	MaxSizeMB  int    `json:"max_size_mb"` // of a file before it is rotated, 100 if 0
+	MaxFiles   int    `json:"max_files"`   // rotated files kept, 0 means all
+	Key        string `json:"key"`         // records are chained with HMAC-SHA256 of the key, SHA-256 if empty
+	FailClosed bool   `json:"fail_closed"` // bridge is disconnected while records cannot be written
 }
 
 type WhitelistEntry struct {
@@ -48,20 +177,153 @@ func Get(path string) *Config {
 	return Deserialize(data)
 }
 
-func (conf *WhitelistMap) Check(ctx context.Context, method string, url *url.URL) error {
-	logger := log.Ctx(ctx)
-	wlEntry := WhitelistEntry{
+// Check returns the first rule which allows the route for the client identified by the headers,
+// or an error if the route is forbidden or the identity does not verify.
+func (conf *WhitelistMap) Check(ctx context.Context, corrID string, method string, url *url.URL, header http.Header) (*WhitelistConfig, error) {
+	wlEntry := entryOf(method, url)
+	rule, id, err := conf.match(corrID, wlEntry, header)
+	if err != nil {
+		log.Ctx(ctx).Warnf("forbidden [%v] identity[%v] error[%v]", wlEntry, id, err)
+	}
+	return rule, err
+}
+
+// Match is Check without logging, for a whitelist in shadow mode.
+func (conf *WhitelistMap) Match(corrID string, method string, url *url.URL, header http.Header) (*WhitelistConfig, error) {
+	rule, _, err := conf.match(corrID, entryOf(method, url), header)
+	return rule, err
+}
+
+func entryOf(method string, url *url.URL) WhitelistEntry {
+	return WhitelistEntry{
 		Netloc: url.Host,
 		Method: strings.ToUpper(method),
 		Scheme: url.Scheme,
 		Path:   url.Path,
 	}
-	_, present := (*conf)[wlEntry]
-	if !present {
-		logger.Warnf("forbidden [%v]\n", wlEntry)
-		return errors.New("forbidden")
+}
+
+func (conf *WhitelistMap) match(corrID string, wlEntry WhitelistEntry, header http.Header) (*WhitelistConfig, *auth.Identity, error) {
+	if !safePath(wlEntry.Path) {
+		return nil, nil, errors.New("forbidden path")
+	}
+	var id *auth.Identity
+	if len(conf.keys) > 0 {
+		// the identity must be signed for this very request
+		req := auth.Request{CorrID: corrID, Method: wlEntry.Method, Netloc: wlEntry.Netloc, Path: wlEntry.Path}
+		var err error
+		if id, err = conf.keys.VerifyIdentity(header, req, time.Now()); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var rule *WhitelistConfig
+	allow := func(r *WhitelistConfig) {
+		if (rule == nil || r.order < rule.order) && r.allows(id) {
+			rule = r
+		}
 	}
-	return nil
+	for _, r := range conf.routes[wlEntry] {
+		allow(r)
+	}
+	for _, g := range conf.globs {
+		if g.matches(wlEntry) {
+			allow(g.rule)
+		}
+	}
+	if rule == nil {
+		return nil, id, errors.New("forbidden")
+	}
+	return rule, id, nil
+}
+
+// newWhitelistMap makes the whitelist of the rules, the identities of clients are verified with keys.
+func newWhitelistMap(rules []WhitelistConfig, keys auth.Keys) *WhitelistMap {
+	// Each whitelist route should be a separate entry in a hashmap for faster lookup, globs are matched in turn
+	whitelistMap := &WhitelistMap{routes: map[WhitelistEntry][]*WhitelistConfig{}, keys: keys}
+	for i := range rules {
+		entry := &rules[i]
+		entry.order = i
+		if entry.restricted() && len(keys) == 0 {
+			errs.Check(errors.New("whitelist rules with roles, scopes or subjects require identity_keys"))
+		}
+		whitelistMap.rules = append(whitelistMap.rules, entry)
+		for _, wle := range entry.entries() {
+			if strings.Contains(wle.Path, "*") {
+				whitelistMap.globs = append(whitelistMap.globs, newGlobRoute(wle, entry))
+			} else {
+				whitelistMap.routes[wle] = append(whitelistMap.routes[wle], entry)
+			}
+		}
+	}
+	return whitelistMap
+}
+
+// entries are the routes of all the rules, for logging.
+func (conf *WhitelistMap) entries() []WhitelistEntry {
+	var entries []WhitelistEntry
+	for _, rule := range conf.rules {
+		entries = append(entries, rule.entries()...)
+	}
+	return entries
+}
+
+// entries are the routes of the rule.
+func (rule *WhitelistConfig) entries() []WhitelistEntry {
+	var entries []WhitelistEntry
+	for _, netloc := range rule.Netloc {
+		for _, method := range rule.Method {
+			for _, scheme := range rule.Scheme {
+				for _, path := range rule.Path {
+					entries = append(entries, WhitelistEntry{
+						Netloc: netloc,
+						Method: strings.ToUpper(method),
+						Scheme: scheme,
+						Path:   path,
+					})
+				}
+			}
+		}
+	}
+	return entries
+}
+
+// String names the rule, by its position in the whitelist if it has no name.
+func (rule *WhitelistConfig) String() string {
+	if rule.Name != "" {
+		return rule.Name
+	}
+	return fmt.Sprintf("whitelist[%d]", rule.order)
+}
+
+// Rules are the rules of the whitelist, in order.
+func (conf *WhitelistMap) Rules() []*WhitelistConfig {
+	return conf.rules
+}
+
+// MaxResponseSizeOf returns the response size limit of the rule, 0 or less means unlimited.
+// A rule can lift the global limit with a negative size.
+func (conf *Config) MaxResponseSizeOf(rule *WhitelistConfig) int64 {
+	if rule != nil && rule.MaxResponseSize != 0 {
+		return rule.MaxResponseSize
+	}
+	return conf.MaxResponseSize
+}
+
+// RetryOf returns the retry policy of the rule.
+func (conf *Config) RetryOf(rule *WhitelistConfig) Retry {
+	if rule != nil && rule.Retry != nil {
+		return *rule.Retry
+	}
+	return conf.Retry
+}
+
+// TimeoutOf returns the timeout of the rule, 0 means no timeout.
+func (conf *Config) TimeoutOf(rule *WhitelistConfig) time.Duration {
+	if rule != nil && rule.TimeoutMs != 0 {
+		return time.Duration(rule.TimeoutMs) * time.Millisecond
+	}
+	return time.Duration(conf.TimeoutMs) * time.Millisecond
 }
 
 func Deserialize(data []byte) *Config {
@@ -69,30 +331,67 @@ func Deserialize(data []byte) *Config {
 	err := json.Unmarshal(data, &conf)
 	errs.Check(err)
 
-	// Each whitelist route should be a separate entry in a hashmap for faster lookup
-	whitelistMap := map[WhitelistEntry]bool{}
-	for _, entry := range conf.Whitelist {
-		for _, netloc := range entry.Netloc {
-			for _, method := range entry.Method {
-				for _, scheme := range entry.Scheme {
-					for _, path := range entry.Path {
-						wle := WhitelistEntry{
-							Netloc: netloc,
-							Method: strings.ToUpper(method),
-							Scheme: scheme,
-							Path:   path,
-						}
-						whitelistMap[wle] = true
-					}
-				}
-			}
+	identityKeys, err := auth.ParseKeys(conf.IdentityKeys)
+	errs.Check(err)
+
+	whitelistMap := newWhitelistMap(conf.Whitelist, identityKeys)
+	logrus.Infof("Constructed whitelist for downstream routes [%v]", whitelistMap.entries())
+	var shadowWhitelistMap *WhitelistMap
+	if conf.ShadowWhitelist != nil {
+		shadowWhitelistMap = newWhitelistMap(conf.ShadowWhitelist, identityKeys)
+		logrus.Infof("Constructed shadow whitelist for downstream routes [%v]", shadowWhitelistMap.entries())
+	}
+
+	policy, err := flow.ParsePolicy(conf.WebsocketOverflowPolicy)
+	errs.Check(err)
+	queueSize := conf.WebsocketQueueSize
+	if queueSize <= 0 {
+		queueSize = 64
+	}
+
+	retryBudget := conf.RetryBudget
+	if retryBudget <= 0 {
+		retryBudget = 0.2
+	}
+
+	if conf.Audit != nil {
+		if conf.Audit.Dir == "" {
+			errs.Check(errors.New("audit requires dir"))
 		}
+		if conf.Audit.MaxSizeMB <= 0 {
+			conf.Audit.MaxSizeMB = 100
+		}
+	}
+
+	tcpWhitelist := map[string]bool{}
+	for _, netloc := range conf.TCPWhitelist {
+		tcpWhitelist[netloc] = true
 	}
-	logrus.Infof("Constructed whitelist for downstream routes [%v]", whitelistMap)
+	logrus.Infof("Constructed whitelist for downstream tcp [%v]", conf.TCPWhitelist)
+
 	confMap := Config{
-		BridgeNetLoc: conf.BridgeNetLoc,
-		BridgeToken:  conf.BridgeToken,
-		WhitelistMap: whitelistMap,
+		BridgeNetLoc:            conf.BridgeNetLoc,
+		BridgeToken:             conf.BridgeToken,
+		WhitelistMap:            *whitelistMap,
+		ShadowWhitelistMap:      shadowWhitelistMap,
+		WebsocketQueueSize:      queueSize,
+		WebsocketOverflowPolicy: policy,
+		TCPWhitelist:            tcpWhitelist,
+		MaxResponseSize:         conf.MaxResponseSize,
+		NetlocLimits:            conf.NetlocLimits,
+		NetlocBreakers:          conf.NetlocBreakers,
+		MetricsAddr:             conf.MetricsAddr,
+		Retry:                   conf.Retry,
+		RetryBudget:             retryBudget,
+		Transport:               conf.Transport,
+		TimeoutMs:               conf.TimeoutMs,
+		NetlocTLS:               conf.NetlocTLS,
+		BridgeTLS:               conf.BridgeTLS,
+		BridgeKeyID:             conf.BridgeKeyID,
+		BridgeKey:               conf.BridgeKey,
+		SealKeys:                conf.SealKeys,
+		IdentityKeys:            conf.IdentityKeys,
+		Audit:                   conf.Audit,
 	}
 	return &confMap
 }
@@ -0,0 +1,93 @@
+package config
+
+import (
+	"path"
+	"strings"
+
+	"github.com/bcmmacro/bridging-go/internal/auth"
+)
+
+// globRoute is a route whose path is a glob of segments, where * matches one segment, or part of one as in
+// /files/*.json, and ** matches any number of segments, e.g. /api/jobs/** matches /api/jobs and all paths below.
+type globRoute struct {
+	entry    WhitelistEntry
+	segments []string
+	rule     *WhitelistConfig
+}
+
+func newGlobRoute(entry WhitelistEntry, rule *WhitelistConfig) globRoute {
+	return globRoute{entry: entry, segments: strings.Split(entry.Path, "/"), rule: rule}
+}
+
+func (g *globRoute) matches(entry WhitelistEntry) bool {
+	return g.entry.Netloc == entry.Netloc && g.entry.Method == entry.Method && g.entry.Scheme == entry.Scheme &&
+		matchSegments(g.segments, strings.Split(entry.Path, "/"))
+}
+
+func matchSegments(pattern []string, segments []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(segments); i++ {
+				if matchSegments(pattern[1:], segments[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segments) == 0 {
+			return false
+		}
+		if ok, err := path.Match(pattern[0], segments[0]); err != nil || !ok {
+			return false
+		}
+		pattern, segments = pattern[1:], segments[1:]
+	}
+	return len(segments) == 0
+}
+
+// safePath tells if the path has no segment which a downstream service may resolve to another path, so that a
+// rule cannot be escaped as by /api/jobs/../admin: no "." or "..", no empty one but the last, no encoded dot.
+func safePath(p string) bool {
+	segments := strings.Split(p, "/")
+	for i, s := range segments {
+		if s == "." || s == ".." || (s == "" && i > 0 && i < len(segments)-1) || strings.Contains(strings.ToLower(s), "%2e") {
+			return false
+		}
+	}
+	return true
+}
+
+// restricted tells if the rule is only for some clients.
+func (rule *WhitelistConfig) restricted() bool {
+	return len(rule.Roles) > 0 || len(rule.Scopes) > 0 || len(rule.Subjects) > 0
+}
+
+// allows tells if the client can take the routes of the rule, id is nil for an anonymous client.
+func (rule *WhitelistConfig) allows(id *auth.Identity) bool {
+	if !rule.restricted() {
+		return true
+	}
+	if id == nil {
+		return false
+	}
+	if len(rule.Roles) > 0 && !containsAny(id.Roles, rule.Roles) {
+		return false
+	}
+	for _, scope := range rule.Scopes {
+		if !containsAny(id.Scopes, []string{scope}) {
+			return false
+		}
+	}
+	return len(rule.Subjects) == 0 || containsAny([]string{id.Subject}, rule.Subjects)
+}
+
+func containsAny(list []string, wanted []string) bool {
+	for _, v := range list {
+		for _, w := range wanted {
+			if v == w {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,115 @@
+package flow
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half_open"
+)
+
+var ErrBreakerOpen = errors.New("circuit breaker open")
+
+// Outcome is how a call went, as far as the breaker is concerned.
+type Outcome int
+
+const (
+	Succeeded Outcome = iota
+	Failed
+	Ignored // the call tells nothing about the service, e.g. it was cancelled by the caller
+)
+
+// Breaker is a circuit breaker. It opens after a number of consecutive failures and rejects calls,
+// once open for long enough it lets a few probe calls through, and closes again if all of them succeed.
+type Breaker struct {
+	mutex     sync.Mutex
+	threshold int
+	openFor   time.Duration
+	probes    int
+	state     string
+	gen       uint64 // bumped on every state change, outcomes of calls from an earlier state are ignored
+	failures  int
+	openedAt  time.Time
+	probing   int
+	passed    int
+}
+
+func NewBreaker(threshold int, openFor time.Duration, probes int) *Breaker {
+	if probes < 1 {
+		probes = 1
+	}
+	return &Breaker{threshold: threshold, openFor: openFor, probes: probes, state: BreakerClosed}
+}
+
+// Allow tells if a call can be made, done must be called with its outcome if so.
+// An ignored call only gives its probe slot back.
+func (b *Breaker) Allow() (done func(outcome Outcome), ok bool) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openFor {
+		b.setState(BreakerHalfOpen)
+	}
+	switch b.state {
+	case BreakerOpen:
+		return nil, false
+	case BreakerHalfOpen:
+		if b.probing >= b.probes {
+			return nil, false
+		}
+		b.probing++
+	}
+	gen := b.gen
+	return func(outcome Outcome) { b.done(gen, outcome) }, true
+}
+
+func (b *Breaker) done(gen uint64, outcome Outcome) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if gen != b.gen {
+		return
+	}
+	switch b.state {
+	case BreakerClosed:
+		if outcome == Succeeded {
+			b.failures = 0
+		} else if outcome == Failed {
+			if b.failures++; b.failures >= b.threshold {
+				b.setState(BreakerOpen)
+			}
+		}
+	case BreakerHalfOpen:
+		b.probing--
+		if outcome == Ignored {
+			return
+		}
+		if outcome == Failed {
+			b.setState(BreakerOpen)
+		} else if b.passed++; b.passed >= b.probes {
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+func (b *Breaker) setState(state string) {
+	b.state = state
+	b.gen++
+	b.failures = 0
+	b.probing = 0
+	b.passed = 0
+	if state == BreakerOpen {
+		b.openedAt = time.Now()
+	}
+}
+
+func (b *Breaker) State() string {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.state == BreakerOpen && time.Since(b.openedAt) >= b.openFor {
+		return BreakerHalfOpen
+	}
+	return b.state
+}
@@ -0,0 +1,67 @@
+package flow
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Bucket is a token bucket, it holds up to burst tokens and is refilled at rate tokens per second.
+type Bucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewBucket makes a full bucket.
+func NewBucket(rate float64, burst int) *Bucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &Bucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+func (b *Bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// Take takes a token if there is one, otherwise returns how long until the next token.
+func (b *Bucket) Take() (bool, time.Duration) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(time.Now())
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / b.rate * float64(time.Second))
+}
+
+// Wait blocks until a token is taken or ctx is done.
+func (b *Bucket) Wait(ctx context.Context) error {
+	for {
+		ok, wait := b.Take()
+		if ok {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Full tells if the bucket is refilled, a full bucket can be dropped and made again.
+func (b *Bucket) Full() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refill(time.Now())
+	return b.tokens >= b.burst
+}
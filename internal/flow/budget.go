@@ -0,0 +1,37 @@
+package flow
+
+import "sync"
+
+// Budget bounds retries to a ratio of the calls, with a reserve for bursts: each call deposits
+// ratio tokens up to the reserve, and each retry withdraws a token.
+type Budget struct {
+	mutex   sync.Mutex
+	ratio   float64
+	reserve float64
+	tokens  float64
+}
+
+// NewBudget makes a full Budget.
+func NewBudget(ratio float64, reserve int) *Budget {
+	return &Budget{ratio: ratio, reserve: float64(reserve), tokens: float64(reserve)}
+}
+
+func (b *Budget) Deposit() {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.tokens += b.ratio
+	if b.tokens > b.reserve {
+		b.tokens = b.reserve
+	}
+}
+
+// Withdraw takes a token for a retry, false if the budget is used up.
+func (b *Budget) Withdraw() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
@@ -0,0 +1,165 @@
+// Package flow provides the building blocks for flow control between the public client,
+// the Bridge, the Gateway and the downstream services: bounded queues with an overflow
+// policy, and credit windows.
+package flow
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type Policy string
+
+const (
+	// PolicyBlock blocks the producer until the consumer catches up.
+	PolicyBlock Policy = "block"
+	// PolicyDropOldest discards the oldest queued item to make room for the new one.
+	PolicyDropOldest Policy = "drop_oldest"
+	// PolicyDisconnect rejects the new item, the owner is expected to tear down the session.
+	PolicyDisconnect Policy = "disconnect"
+)
+
+var (
+	ErrOverflow = errors.New("queue overflow")
+	ErrClosed   = errors.New("queue closed")
+)
+
+// ParsePolicy converts s to a Policy, an empty string means PolicyBlock.
+func ParsePolicy(s string) (Policy, error) {
+	switch p := Policy(s); p {
+	case "":
+		return PolicyBlock, nil
+	case PolicyBlock, PolicyDropOldest, PolicyDisconnect:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown overflow policy[%s]", s)
+	}
+}
+
+// Queue is a bounded FIFO, what happens when it is full is decided by its Policy.
+type Queue struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	items  []interface{}
+	size   int
+	policy Policy
+	closed bool
+}
+
+func NewQueue(size int, policy Policy) *Queue {
+	if size <= 0 {
+		size = 1
+	}
+	q := &Queue{size: size, policy: policy}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// Push appends item to the queue, it returns the number of items dropped to make room for it.
+func (q *Queue) Push(item interface{}) (int, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	dropped := 0
+	for !q.closed && len(q.items) >= q.size {
+		switch q.policy {
+		case PolicyDropOldest:
+			q.items[0] = nil
+			q.items = q.items[1:]
+			dropped++
+		case PolicyDisconnect:
+			return 0, ErrOverflow
+		default:
+			q.cond.Wait()
+		}
+	}
+	if q.closed {
+		return dropped, ErrClosed
+	}
+	q.items = append(q.items, item)
+	q.cond.Broadcast()
+	return dropped, nil
+}
+
+// Pop blocks until an item is available. It returns false once the queue is closed and drained.
+func (q *Queue) Pop() (interface{}, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && len(q.items) == 0 {
+		q.cond.Wait()
+	}
+	if len(q.items) == 0 {
+		return nil, false
+	}
+	item := q.items[0]
+	q.items[0] = nil
+	q.items = q.items[1:]
+	q.cond.Broadcast()
+	return item, true
+}
+
+// Len returns the number of queued items.
+func (q *Queue) Len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return len(q.items)
+}
+
+// Close rejects further pushes, items already queued can still be popped.
+func (q *Queue) Close() {
+	q.mutex.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+}
+
+// Credit is a send window, the sender acquires one credit per message and the receiver
+// grants credits back once the messages are consumed.
+type Credit struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	n         int64
+	unlimited bool
+	closed    bool
+}
+
+// NewCredit creates a window of n credits, n <= 0 means the window is unlimited.
+func NewCredit(n int64) *Credit {
+	c := &Credit{n: n, unlimited: n <= 0}
+	c.cond = sync.NewCond(&c.mutex)
+	return c
+}
+
+// Acquire blocks until a credit is available, it returns false if the window is closed.
+func (c *Credit) Acquire() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for !c.closed && !c.unlimited && c.n <= 0 {
+		c.cond.Wait()
+	}
+	if c.closed {
+		return false
+	}
+	if !c.unlimited {
+		c.n--
+	}
+	return true
+}
+
+func (c *Credit) Grant(n int64) {
+	c.mutex.Lock()
+	c.n += n
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+}
+
+// Close wakes up all waiters, subsequent Acquire returns false.
+func (c *Credit) Close() {
+	c.mutex.Lock()
+	c.closed = true
+	c.cond.Broadcast()
+	c.mutex.Unlock()
+}
@@ -0,0 +1,45 @@
+package flow
+
+import (
+	"errors"
+	"io"
+)
+
+var ErrTooLarge = errors.New("body too large")
+
+// limitedBody fails with ErrTooLarge once more than n bytes are read, unlike io.LimitReader
+// which hides the rest of the body.
+type limitedBody struct {
+	body io.ReadCloser
+	left int64
+}
+
+// LimitBody caps body at n bytes, n <= 0 means unlimited.
+func LimitBody(body io.ReadCloser, n int64) io.ReadCloser {
+	if n <= 0 {
+		return body
+	}
+	return &limitedBody{body: body, left: n}
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.left < 0 {
+		return 0, ErrTooLarge
+	}
+	// read one more byte than allowed to tell a body of exactly n bytes from a larger one
+	if int64(len(p)) > b.left+1 {
+		p = p[:b.left+1]
+	}
+	n, err := b.body.Read(p)
+	if int64(n) > b.left {
+		n = int(b.left)
+		b.left = -1
+		return n, ErrTooLarge
+	}
+	b.left -= int64(n)
+	return n, err
+}
+
+func (b *limitedBody) Close() error {
+	return b.body.Close()
+}
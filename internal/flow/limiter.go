@@ -0,0 +1,66 @@
+package flow
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrQueueTimeout = errors.New("queue timeout")
+
+// Limiter bounds concurrent calls, calls beyond the limit wait in a bounded queue for up to a timeout.
+type Limiter struct {
+	slots     chan struct{}
+	mutex     sync.Mutex
+	waiting   int
+	queueSize int
+	timeout   time.Duration
+}
+
+// NewLimiter makes a Limiter of max concurrent calls, timeout <= 0 means waiting until ctx is done.
+func NewLimiter(max int, queueSize int, timeout time.Duration) *Limiter {
+	return &Limiter{slots: make(chan struct{}, max), queueSize: queueSize, timeout: timeout}
+}
+
+// Acquire takes a slot, it fails with ErrOverflow if the queue is full, or ErrQueueTimeout if no slot
+// frees up in time. Release must be called after a successful Acquire.
+func (l *Limiter) Acquire(ctx context.Context) error {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+
+	l.mutex.Lock()
+	if l.waiting >= l.queueSize {
+		l.mutex.Unlock()
+		return ErrOverflow
+	}
+	l.waiting++
+	l.mutex.Unlock()
+	defer func() {
+		l.mutex.Lock()
+		l.waiting--
+		l.mutex.Unlock()
+	}()
+
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return ErrQueueTimeout
+		}
+		return ctx.Err()
+	}
+}
+
+func (l *Limiter) Release() {
+	<-l.slots
+}
@@ -18,13 +18,22 @@ import (
 type Args struct {
 	Method     string              `json:"method,omitempty"` // http method
 	URL        string              `json:"url,omitempty"`
+	Scheme     string              `json:"scheme,omitempty"` // scheme of the original request, http or https
+	Host       string              `json:"host,omitempty"`   // host of the original request
+	Path       string              `json:"path,omitempty"`   // escaped path of the original request
+	RawQuery   string              `json:"raw_query,omitempty"`
 	Headers    map[string][]string `json:"headers,omitempty"`
+	Trailers   map[string][]string `json:"trailers,omitempty"`
 	Client     string              `json:"client,omitempty"`
 	WSID       string              `json:"ws_id,omitempty"`
+	TCPID      string              `json:"tcp_id,omitempty"`
 	Msg        string              `json:"msg,omitempty"`
 	StatusCode int64               `json:"status_code,omitempty"`
 	Exception  string              `json:"exception,omitempty"`
 	Body       []byte              `json:"body,omitempty"`
+	Credit     int64               `json:"credit,omitempty"` // websocket or tcp send window granted by the peer
+	Stream     bool                `json:"stream,omitempty"` // response body follows in http_body packets
+	EOF        bool                `json:"eof,omitempty"`    // last http_body packet of a stream
 }
 
 func (args *Args) String() string {
@@ -35,15 +44,30 @@ func (args *Args) String() string {
 // to avoid long unreadable log lines
 func (args *Args) truncated() *Args {
 	return &Args{Method: args.Method, URL: args.URL,
-		Headers: args.Headers, Client: args.Client, WSID: args.WSID,
+		Scheme: args.Scheme, Host: args.Host, Path: args.Path, RawQuery: args.RawQuery,
+		Headers: args.Headers, Trailers: args.Trailers, Client: args.Client, WSID: args.WSID, TCPID: args.TCPID,
 		Msg: common.CutStr(args.Msg, 1000), StatusCode: args.StatusCode, Exception: args.Exception,
-		Body: common.CutByte(args.Body, 1000),
+		Body: common.CutByte(args.Body, 1000), Credit: args.Credit,
+		Stream: args.Stream, EOF: args.EOF,
 	}
 }
 
+// targetURL is the url of the original request with the given scheme,
+// URL is used if the request comes from a bridge which does not send the split fields.
+func (args *Args) targetURL(scheme string) (*url.URL, error) {
+	if args.Path == "" {
+		return url.Parse(args.URL)
+	}
+	u := fmt.Sprintf("%s://%s%s", scheme, args.Host, args.Path)
+	if args.RawQuery != "" {
+		u += "?" + args.RawQuery
+	}
+	return url.Parse(u)
+}
+
 // urlTransform replaces original url to bridging-base-url.
 func (args *Args) UrlTransform() (string, error) {
-	url, err := url.Parse(args.URL)
+	url, err := args.targetURL("http")
 	if err != nil {
 		return "", err
 	}
@@ -58,7 +82,7 @@ func (args *Args) UrlTransform() (string, error) {
 
 // wsUrlTransform is the sibling function to urlTransform for websocket destination.
 func (args *Args) WsUrlTransform() (*url.URL, error) {
-	url, err := url.Parse(args.URL)
+	url, err := args.targetURL("ws")
 	if err != nil {
 		return nil, err
 	}
@@ -82,8 +106,18 @@ const (
 	CLOSE_WEBSOCKET_RESULT PacketMethod = "close_websocket_result"
 	CLOSE_WEBSOCKET        PacketMethod = "close_websocket"
 	WEBSOCKET_MSG          PacketMethod = "websocket_msg"
+	WEBSOCKET_ACK          PacketMethod = "websocket_ack"
 	HTTP_RESULT            PacketMethod = "http_result"
 	HTTP                   PacketMethod = "http"
+	HTTP_BODY              PacketMethod = "http_body"
+	HTTP_INFO              PacketMethod = "http_info" // 1xx informational response before http_result
+	HTTP_CANCEL            PacketMethod = "http_cancel"
+	GRPC                   PacketMethod = "grpc" // bidirectional stream, bodies in http_body packets both ways
+	OPEN_TCP_RESULT        PacketMethod = "open_tcp_result"
+	OPEN_TCP               PacketMethod = "open_tcp"
+	TCP_DATA               PacketMethod = "tcp_data"
+	CLOSE_TCP              PacketMethod = "close_tcp"
+	TCP_ACK                PacketMethod = "tcp_ack" // grants the tcp window back, like websocket_ack
 )
 
 type Packet struct {
@@ -171,11 +205,31 @@ func (p *Packet) Serialize(ctx context.Context, compressor *gzip.Writer) ([]byte
 
 func MakeHTTPReqArgs(ctx context.Context, r *http.Request) (*Args, error) {
 	logger := log.Ctx(ctx)
+	args := MakeStreamReqArgs(r)
 
+	if body, err := ioutil.ReadAll(r.Body); err != nil {
+		logger.Warnf("failed to read body error[%v]", err)
+		return nil, err
+	} else {
+		args.Body = body
+	}
+	return args, nil
+}
+
+// MakeStreamReqArgs makes the head of a streamed request, the body is sent separately.
+func MakeStreamReqArgs(r *http.Request) *Args {
 	var args Args
 	args.Method = r.Method
 
-	// TODO(zzl) should split URL
+	args.Scheme = "http"
+	if r.TLS != nil {
+		args.Scheme = "https"
+	}
+	args.Host = r.Host
+	args.Path = r.URL.EscapedPath()
+	args.RawQuery = r.URL.RawQuery
+
+	// URL is kept for gateways which do not know the split fields
 	scheme := "http"
 	if r.Header.Get("Upgrade") == "websocket" {
 		scheme = "ws"
@@ -187,6 +241,13 @@ func MakeHTTPReqArgs(ctx context.Context, r *http.Request) (*Args, error) {
 	for k, v := range r.Header {
 		args.Headers[k] = append([]string(nil), v...)
 	}
+	return &args
+}
+
+func MakeHTTPRespArgs(ctx context.Context, r *http.Response) (*Args, error) {
+	logger := log.Ctx(ctx)
+	args := MakeHTTPStreamRespArgs(r)
+	args.Stream = false
 
 	if body, err := ioutil.ReadAll(r.Body); err != nil {
 		logger.Warnf("failed to read body error[%v]", err)
@@ -194,11 +255,15 @@ func MakeHTTPReqArgs(ctx context.Context, r *http.Request) (*Args, error) {
 	} else {
 		args.Body = body
 	}
-	return &args, nil
+	// trailers are only known once the body is read
+	if len(r.Trailer) > 0 {
+		args.Trailers = map[string][]string(r.Trailer)
+	}
+	return args, nil
 }
 
-func MakeHTTPRespArgs(ctx context.Context, r *http.Response) (*Args, error) {
-	logger := log.Ctx(ctx)
+// MakeHTTPStreamRespArgs makes the head of a streamed response, the body is sent separately.
+func MakeHTTPStreamRespArgs(r *http.Response) *Args {
 	var args Args
 
 	args.Headers = make(map[string][]string)
@@ -207,14 +272,8 @@ func MakeHTTPRespArgs(ctx context.Context, r *http.Response) (*Args, error) {
 	}
 
 	args.StatusCode = int64(r.StatusCode)
-
-	if body, err := ioutil.ReadAll(r.Body); err != nil {
-		logger.Warnf("failed to read body error[%v]", err)
-		return nil, err
-	} else {
-		args.Body = body
-	}
-	return &args, nil
+	args.Stream = true
+	return &args
 }
 
 func MakeHTTPErrprRespArgs(statusCode int) *Args {
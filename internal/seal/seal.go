@@ -0,0 +1,155 @@
+// Package seal seals the packets on /bridge with AES-256-GCM, so that a proxy which terminates TLS in front of
+// bridge can neither read nor change them. Each packet carries a sequence number and is bound to a salt which its
+// receiver picks for the connection, so that it can neither be replayed, dropped nor reordered within the connection, nor replayed into another one.
+package seal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	version   = 1
+	keySize   = 32
+	saltSize  = 16
+	nonceSize = 12
+)
+
+var (
+	ErrMalformed  = errors.New("malformed sealed packet")
+	ErrUnknownKey = errors.New("unknown seal key")
+	ErrTampered   = errors.New("tampered sealed packet")
+	ErrReplayed   = errors.New("replayed sealed packet")
+	ErrMissing    = errors.New("sealed packets missing before this one")
+)
+
+// Hello is sent by each side right after connecting, the salt binds the packets sent to that side.
+type Hello struct {
+	Salt []byte `json:"salt"`
+}
+
+func NewHello() (Hello, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return Hello{}, err
+	}
+	return Hello{Salt: salt}, nil
+}
+
+// Keys are the keys shared by bridge and gateway, packets are sealed with the first one and opened with any.
+// To rotate, add the new key after the current one on both sides, move it to the front, then remove the old one.
+type Keys struct {
+	sealID string
+	aeads  map[string]cipher.AEAD
+}
+
+// ParseKeys parses keys like "2023-11:<base64 of 32 bytes>,2023-10:<base64 of 32 bytes>", nil if s is empty.
+func ParseKeys(s string) (*Keys, error) {
+	keys := &Keys{aeads: map[string]cipher.AEAD{}}
+	for _, kv := range strings.Split(s, ",") {
+		kv = strings.TrimSpace(kv)
+		if kv == "" {
+			continue
+		}
+		i := strings.Index(kv, ":")
+		if i <= 0 || i > 255 {
+			return nil, fmt.Errorf("invalid seal key, expecting <key id>:<base64 key>")
+		}
+		id := kv[:i]
+		key, err := base64.StdEncoding.DecodeString(kv[i+1:])
+		if err != nil || len(key) != keySize {
+			return nil, fmt.Errorf("seal key[%s] must be %d bytes in base64", id, keySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if keys.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+		if keys.sealID == "" {
+			keys.sealID = id
+		}
+	}
+	if keys.sealID == "" {
+		return nil, nil
+	}
+	return keys, nil
+}
+
+// Session seals and opens the packets of one connection.
+// Seal and Open can run concurrently to each other, but neither concurrently to itself.
+type Session struct {
+	keys     *Keys
+	own      []byte // salt of the packets this side receives
+	peer     []byte // salt of the packets this side sends
+	sent     uint64
+	received uint64
+}
+
+func (k *Keys) NewSession(own, peer Hello) (*Session, error) {
+	if len(peer.Salt) != saltSize {
+		return nil, fmt.Errorf("salt of peer must be %d bytes", saltSize)
+	}
+	return &Session{keys: k, own: own.Salt, peer: peer.Salt}, nil
+}
+
+// Seal encrypts data into <version><key id length><key id><sequence><nonce><ciphertext>,
+// everything before the nonce is authenticated along with the salt of the peer.
+func (s *Session) Seal(data []byte) ([]byte, error) {
+	head := make([]byte, 0, 2+len(s.keys.sealID)+8+nonceSize)
+	head = append(head, version, byte(len(s.keys.sealID)))
+	head = append(head, s.keys.sealID...)
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], s.sent+1)
+	head = append(head, seq[:]...)
+
+	nonce := make([]byte, nonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// numbered only once sealed, as the peer takes a gap in the numbers for a dropped packet
+	s.sent++
+	aad := append(append([]byte{}, head...), s.peer...)
+	return s.keys.aeads[s.keys.sealID].Seal(append(head, nonce...), nonce, data, aad), nil
+}
+
+// Open decrypts a sealed packet, which must come right after the one opened before. A packet which does not,
+// as one before it was dropped, is rejected, and the connection cannot be trusted any more.
+func (s *Session) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < 2 || sealed[0] != version {
+		return nil, ErrMalformed
+	}
+	idLen := int(sealed[1])
+	headLen := 2 + idLen + 8
+	if len(sealed) < headLen+nonceSize {
+		return nil, ErrMalformed
+	}
+	aead, present := s.keys.aeads[string(sealed[2:2+idLen])]
+	if !present {
+		return nil, ErrUnknownKey
+	}
+	head := sealed[:headLen]
+	nonce := sealed[headLen : headLen+nonceSize]
+	aad := append(append([]byte{}, head...), s.own...)
+	data, err := aead.Open(nil, nonce, sealed[headLen+nonceSize:], aad)
+	if err != nil {
+		return nil, ErrTampered
+	}
+	// only checked once authentic, so that a forged sequence cannot block the genuine packets
+	seq := binary.BigEndian.Uint64(head[2+idLen:])
+	if seq <= s.received {
+		return nil, ErrReplayed
+	}
+	if seq != s.received+1 {
+		return nil, ErrMissing
+	}
+	s.received = seq
+	return data, nil
+}
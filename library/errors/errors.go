@@ -16,6 +16,7 @@ var ( // 5xxx internal err
 	ErrPanic           = CodeMsgData{code: 5100, httpStatusCode: 500}
 	ErrAuth            = CodeMsgData{code: 5101, httpStatusCode: 500}
 	ErrBackendService  = CodeMsgData{code: 5102, httpStatusCode: 502}
+	ErrUnavailable     = CodeMsgData{code: 5003, httpStatusCode: 503}
 )
 
 var ( // 4xxx client err
@@ -26,6 +27,8 @@ var ( // 4xxx client err
 	ErrMethodForbidden  = CodeMsgData{code: 4005, httpStatusCode: 405}
 	ErrConflict         = CodeMsgData{code: 4006, httpStatusCode: 409}
 	ErrServerTimeout    = CodeMsgData{code: 4008, httpStatusCode: 408}
+	ErrPayloadTooLarge  = CodeMsgData{code: 4013, httpStatusCode: 413}
+	ErrTooManyRequests  = CodeMsgData{code: 4029, httpStatusCode: 429}
 	ErrHelpdeskDisabled = CodeMsgData{code: 4009, httpStatusCode: 403}
 	ErrContextCanceled  = CodeMsgData{code: 4099, httpStatusCode: 499}
 )
@@ -0,0 +1,70 @@
+// Package metrics publishes runtime metrics with expvar, and serves them on a dedicated address.
+package metrics
+
+import (
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Serve exposes all published metrics at http://addr/debug/vars in background.
+func Serve(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+	go func() {
+		logrus.Infof("serving metrics on %s", addr)
+		logrus.Errorf("metrics server stopped error[%v]", http.ListenAndServe(addr, mux))
+	}()
+}
+
+// Histogram counts observations into cumulative buckets, it implements expvar.Var.
+type Histogram struct {
+	mutex  sync.Mutex
+	bounds []float64
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+// NewHistogram creates and publishes a histogram with the given upper bounds.
+func NewHistogram(name string, bounds ...float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	h := &Histogram{bounds: bounds, counts: make([]int64, len(bounds))}
+	expvar.Publish(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// String implements expvar.Var
+func (h *Histogram) String() string {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	buckets := make(map[string]int64, len(h.bounds)+1)
+	for i, b := range h.bounds {
+		buckets[strconv.FormatFloat(b, 'g', -1, 64)] = h.counts[i]
+	}
+	buckets["+Inf"] = h.count
+	s, _ := json.Marshal(struct {
+		Count   int64            `json:"count"`
+		Sum     float64          `json:"sum"`
+		Buckets map[string]int64 `json:"buckets"`
+	}{h.count, h.sum, buckets})
+	return string(s)
+}